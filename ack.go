@@ -0,0 +1,86 @@
+package marina
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidTopicFilter = errors.New("the topic filter is invalid")
+	ErrUnknownTwin        = errors.New("the twin is unknown")
+	ErrNoSubscription     = errors.New("no subscription existed")
+	ErrNotAuthorized      = errors.New("not authorized")
+	ErrInvalidQos         = errors.New("the qos is invalid")
+)
+
+// The result code of the subscribing or unsubscribing operation for one topic, like the reason code of the MQTT.
+// The code below 0x80 means success, which is the granted qos for subscribing and zero for unsubscribing.
+type AckCode byte
+
+const (
+	AckGrantedQos0      AckCode = 0x00
+	AckGrantedQos1      AckCode = 0x01
+	AckGrantedQos2      AckCode = 0x02
+	AckUnspecifiedError AckCode = 0x80
+	AckUnknownTwin      AckCode = 0x81
+	AckNoSubscription   AckCode = 0x82
+	AckNotAuthorized    AckCode = 0x87
+	AckInvalidFilter    AckCode = 0x8F
+	AckQuotaExceeded    AckCode = 0x97
+)
+
+func (c AckCode) Success() bool {
+	return c < 0x80
+}
+
+func (c AckCode) String() string {
+	switch c {
+	case AckGrantedQos0:
+		return "granted qos 0"
+	case AckGrantedQos1:
+		return "granted qos 1"
+	case AckGrantedQos2:
+		return "granted qos 2"
+	case AckUnspecifiedError:
+		return "unspecified error"
+	case AckUnknownTwin:
+		return "unknown twin"
+	case AckNoSubscription:
+		return "no subscription existed"
+	case AckNotAuthorized:
+		return "not authorized"
+	case AckInvalidFilter:
+		return "invalid topic filter"
+	case AckQuotaExceeded:
+		return "quota exceeded"
+	default:
+		return fmt.Sprintf("ack code 0x%02x", byte(c))
+	}
+}
+
+// Return the result code by the error, the granted qos for the successful subscribing.
+// The qos above 2 is never granted.
+func ackCodeOf(qos byte, err error) AckCode {
+	switch {
+	case err == nil && qos <= byte(AckGrantedQos2):
+		return AckCode(qos)
+	case errors.Is(err, ErrInvalidTopicFilter):
+		return AckInvalidFilter
+	case errors.Is(err, ErrUnknownTwin):
+		return AckUnknownTwin
+	case errors.Is(err, ErrNoSubscription):
+		return AckNoSubscription
+	case errors.Is(err, ErrNotAuthorized):
+		return AckNotAuthorized
+	case errors.Is(err, ErrQuotaExceeded), errors.Is(err, ErrTenantQuotaExceeded):
+		return AckQuotaExceeded
+	default:
+		return AckUnspecifiedError
+	}
+}
+
+// The acknowledgement of the subscribing or unsubscribing operations, like the SUBACK/UNSUBACK of the MQTT.
+type Ack struct {
+	Unsubscribe bool
+	Results     []SubscribeResult
+}
@@ -0,0 +1,98 @@
+package marina
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/TheSmallBoat/cabinet"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+// The provider records the received acknowledgements.
+type ackProvider struct {
+	provider
+
+	mu   sync.Mutex
+	acks []*Ack
+}
+
+func (p *ackProvider) ReceiveAck(ack *Ack) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.acks = append(p.acks, ack)
+}
+
+func TestAckCode(t *testing.T) {
+	require.Equal(t, AckGrantedQos1, ackCodeOf(1, nil))
+	require.Equal(t, AckInvalidFilter, ackCodeOf(0, ErrInvalidTopicFilter))
+	require.Equal(t, AckUnknownTwin, ackCodeOf(0, ErrUnknownTwin))
+	require.Equal(t, AckNotAuthorized, ackCodeOf(0, ErrNotAuthorized))
+	require.Equal(t, AckUnspecifiedError, ackCodeOf(0, ErrRateLimited))
+	require.Equal(t, AckUnspecifiedError, ackCodeOf(7, nil))
+	require.Equal(t, AckUnspecifiedError, ackCodeOf(7, ErrInvalidQos))
+	require.True(t, AckGrantedQos2.Success())
+	require.False(t, AckNoSubscription.Success())
+	require.Equal(t, "invalid topic filter", AckInvalidFilter.String())
+}
+
+func TestSubscribeWorkerAck(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		err := tt.Close()
+		require.NoError(t, err)
+	}()
+
+	twp := NewTwinsPool()
+	defer twp.Close()
+
+	sw := NewSubscribeWorker(twp, tt)
+	defer sw.Close()
+
+	kid1, err1 := generateKadId()
+	require.NoError(t, err1)
+	kid2, err2 := generateKadId()
+	require.NoError(t, err2)
+
+	ap := &ackProvider{provider: provider{kadId: kid1}}
+	var prd1 TwinServiceProvider = ap
+
+	result := <-sw.PeerNodeSubscribe(&prd1, byte(1), []byte("/finance/tom"))
+	require.NoError(t, result.Err)
+	require.Equal(t, AckGrantedQos1, result.Code)
+
+	result = <-sw.PeerNodeSubscribe(&prd1, byte(0), []byte("/finance/#/tom"))
+	require.True(t, errors.Is(result.Err, ErrInvalidTopicFilter))
+	require.Equal(t, AckInvalidFilter, result.Code)
+
+	// the qos above 2 is never granted
+	result = <-sw.PeerNodeSubscribe(&prd1, byte(7), []byte("/finance/jack"))
+	require.True(t, errors.Is(result.Err, ErrInvalidQos))
+	require.Equal(t, AckUnspecifiedError, result.Code)
+	require.Equal(t, []Subscription{{Topic: []byte("/finance/tom"), Qos: 1}}, twp.SubscriptionsOf(kid1.Pub))
+
+	result = <-sw.PeerNodeUnSubscribe(kid1.Pub, byte(0), []byte("/finance/jack"))
+	require.Equal(t, AckNoSubscription, result.Code)
+
+	result = <-sw.PeerNodeUnSubscribe(kid2.Pub, byte(0), []byte("/finance/tom"))
+	require.Equal(t, AckUnknownTwin, result.Code)
+
+	results := <-sw.UnsubscribeAll(kid1.Pub)
+	require.Equal(t, 1, len(results))
+	require.Equal(t, AckGrantedQos0, results[0].Code)
+	sw.Wait()
+
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	require.Equal(t, 5, len(ap.acks))
+	require.False(t, ap.acks[0].Unsubscribe)
+	require.Equal(t, AckGrantedQos1, ap.acks[0].Results[0].Code)
+	require.Equal(t, AckInvalidFilter, ap.acks[1].Results[0].Code)
+	require.Equal(t, AckUnspecifiedError, ap.acks[2].Results[0].Code)
+	require.True(t, ap.acks[3].Unsubscribe)
+	require.Equal(t, []byte("/finance/tom"), ap.acks[4].Results[0].Topic)
+}
@@ -0,0 +1,249 @@
+package marina
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lithdew/kademlia"
+)
+
+// The action to be authorized.
+type AccessAction byte
+
+const (
+	AccessAll       AccessAction = iota // Only for the rules, which apply to all of the actions.
+	AccessPublish                       // Publish the message-packets to the topic.
+	AccessSubscribe                     // Subscribe the topic filter.
+)
+
+func (a AccessAction) String() string {
+	switch a {
+	case AccessAll:
+		return "all"
+	case AccessPublish:
+		return "publish"
+	case AccessSubscribe:
+		return "subscribe"
+	default:
+		return fmt.Sprintf("access action %d", byte(a))
+	}
+}
+
+// The hook consulted by the publish worker and the subscribe worker, return false to deny the action.
+// The topic is the topic for publishing or the topic filter for subscribing.
+type Authorizer interface {
+	Authorize(pubK kademlia.PublicKey, action AccessAction, topic []byte) bool
+}
+
+// The adapter to use the ordinary function as the Authorizer.
+type AuthorizerFunc func(pubK kademlia.PublicKey, action AccessAction, topic []byte) bool
+
+func (f AuthorizerFunc) Authorize(pubK kademlia.PublicKey, action AccessAction, topic []byte) bool {
+	return f(pubK, action, topic)
+}
+
+// Return true if the peer-node is authorized, otherwise count and report the denial.
+func authorize(az Authorizer, dnh DenialHandler, counter *uint32, pubK kademlia.PublicKey, action AccessAction, topic []byte) bool {
+	if az == nil || az.Authorize(pubK, action, topic) {
+		return true
+	}
+	atomic.AddUint32(counter, uint32(1))
+	if dnh != nil {
+		dnh(&AccessDenial{Time: time.Now(), PubKey: pubK, Action: action, Topic: topic})
+	}
+	return false
+}
+
+// The report of the denied action.
+type AccessDenial struct {
+	Time   time.Time
+	PubKey kademlia.PublicKey
+	Action AccessAction
+	Topic  []byte
+}
+
+// The handler for the denied actions, which is called synchronously and should not block.
+type DenialHandler func(ad *AccessDenial)
+
+// The rule of the access control list.
+type ACLRule struct {
+	Allow  bool
+	Any    bool               // If true, the rule applies to all of the peer-nodes, otherwise only to the PubKey.
+	PubKey kademlia.PublicKey // The public key of the peer-node.
+	Action AccessAction       // The AccessAll means all of the actions.
+	Filter []byte             // The topic filter with the wildcards.
+}
+
+// The access control list, the first matched rule decides the action, and the default decides the unmatched ones.
+// For publishing, the rule matches if its filter matches the topic.
+// For subscribing, the allowing rule matches if its filter covers the requested filter,
+// and the denying rule matches if its filter overlaps the requested filter.
+type ACL struct {
+	defaultAllow bool
+	rules        []ACLRule
+}
+
+func NewACL(defaultAllow bool, rules ...ACLRule) *ACL {
+	return &ACL{
+		defaultAllow: defaultAllow,
+		rules:        append([]ACLRule(nil), rules...),
+	}
+}
+
+// Load the access control list from the file, see the ParseACL for the format.
+func LoadACL(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseACL(f)
+}
+
+// Parse the access control list, one rule per line, the empty lines and the lines starting with '#' are ignored.
+//
+//	default allow|deny
+//	allow|deny publish|subscribe|all <hex public key>|* <topic filter>
+//
+// The default is deny if not specified.
+func ParseACL(r io.Reader) (*ACL, error) {
+	acl := NewACL(false)
+
+	sc := bufio.NewScanner(r)
+	for num := 1; sc.Scan(); num++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+
+		if fields[0] == "default" {
+			if len(fields) != 2 || (fields[1] != "allow" && fields[1] != "deny") {
+				return nil, fmt.Errorf("acl line %d: the default must be 'allow' or 'deny'", num)
+			}
+			acl.defaultAllow = fields[1] == "allow"
+			continue
+		}
+
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("acl line %d: the rule needs 4 fields, got %d", num, len(fields))
+		}
+		var rule ACLRule
+		switch fields[0] {
+		case "allow":
+			rule.Allow = true
+		case "deny":
+			rule.Allow = false
+		default:
+			return nil, fmt.Errorf("acl line %d: unknown permission '%s'", num, fields[0])
+		}
+		switch fields[1] {
+		case "all":
+			rule.Action = AccessAll
+		case "publish":
+			rule.Action = AccessPublish
+		case "subscribe":
+			rule.Action = AccessSubscribe
+		default:
+			return nil, fmt.Errorf("acl line %d: unknown action '%s'", num, fields[1])
+		}
+		if fields[2] == "*" {
+			rule.Any = true
+		} else {
+			key, err := hex.DecodeString(fields[2])
+			if err != nil || len(key) != len(rule.PubKey) {
+				return nil, fmt.Errorf("acl line %d: invalid public key '%s'", num, fields[2])
+			}
+			copy(rule.PubKey[:], key)
+		}
+		rule.Filter = []byte(fields[3])
+		if err := ValidateTopicFilter(rule.Filter); err != nil {
+			return nil, fmt.Errorf("acl line %d: %w", num, err)
+		}
+		acl.rules = append(acl.rules, rule)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func (acl *ACL) Authorize(pubK kademlia.PublicKey, action AccessAction, topic []byte) bool {
+	if action == AccessSubscribe {
+		if _, f, shared, err := parseSharedTopic(topic); err != nil {
+			return false
+		} else if shared {
+			topic = f
+		}
+	}
+
+	for i := range acl.rules {
+		r := &acl.rules[i]
+		if (!r.Any && r.PubKey != pubK) || (r.Action != AccessAll && r.Action != action) {
+			continue
+		}
+		var matched bool
+		switch {
+		case action != AccessSubscribe:
+			matched = MatchTopic(r.Filter, topic)
+		case r.Allow:
+			matched = coverTopic(r.Filter, topic)
+		default:
+			matched = overlapTopic(r.Filter, topic)
+		}
+		if matched {
+			return r.Allow
+		}
+	}
+	return acl.defaultAllow
+}
+
+// Return true if all the topics matched by the filter are matched by the cover too.
+func coverTopic(cover []byte, filter []byte) bool {
+	for len(cover) > 0 {
+		var cl, fl []byte
+		cl, cover = nextTopicLevel(cover)
+		if isLevel(cl, multiLevelWildcard) {
+			return len(filter) > 0
+		}
+		if len(filter) == 0 {
+			return false
+		}
+		fl, filter = nextTopicLevel(filter)
+		if isLevel(fl, multiLevelWildcard) {
+			return false
+		}
+		if !isLevel(cl, singleLevelWildcard) && !bytes.Equal(cl, fl) {
+			return false
+		}
+	}
+	return len(filter) == 0
+}
+
+// Return true if any topic is matched by both of the filters.
+func overlapTopic(a []byte, b []byte) bool {
+	for len(a) > 0 && len(b) > 0 {
+		var al, bl []byte
+		al, a = nextTopicLevel(a)
+		bl, b = nextTopicLevel(b)
+		if isLevel(al, multiLevelWildcard) || isLevel(bl, multiLevelWildcard) {
+			return true
+		}
+		if !isLevel(al, singleLevelWildcard) && !isLevel(bl, singleLevelWildcard) && !bytes.Equal(al, bl) {
+			return false
+		}
+	}
+	return len(a) == 0 && len(b) == 0
+}
+
+func isLevel(level []byte, c byte) bool {
+	return len(level) == 1 && level[0] == c
+}
@@ -0,0 +1,112 @@
+package marina
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/TheSmallBoat/cabinet"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestACL(t *testing.T) {
+	kid1, err1 := generateKadId()
+	require.NoError(t, err1)
+	kid2, err2 := generateKadId()
+	require.NoError(t, err2)
+
+	text := `
+# the sensors publish their own telemetry
+deny  all       *  secret/#
+allow publish   ` + hex.EncodeToString(kid1.Pub[:]) + `  telemetry/+/cpu
+allow subscribe *  telemetry/#
+default deny
+`
+	path := filepath.Join(t.TempDir(), "acl.conf")
+	require.NoError(t, os.WriteFile(path, []byte(text), 0600))
+	acl, err := LoadACL(path)
+	require.NoError(t, err)
+
+	require.True(t, acl.Authorize(kid1.Pub, AccessPublish, []byte("telemetry/a/cpu")))
+	require.False(t, acl.Authorize(kid2.Pub, AccessPublish, []byte("telemetry/a/cpu")))
+	require.False(t, acl.Authorize(kid1.Pub, AccessPublish, []byte("telemetry/a/mem")))
+	require.False(t, acl.Authorize(kid1.Pub, AccessPublish, []byte("secret/a")))
+
+	// the allowing rule covers the requested filter
+	require.True(t, acl.Authorize(kid2.Pub, AccessSubscribe, []byte("telemetry/+/cpu")))
+	require.True(t, acl.Authorize(kid2.Pub, AccessSubscribe, []byte("$share/workers/telemetry/#")))
+	require.False(t, acl.Authorize(kid2.Pub, AccessSubscribe, []byte("+/a/cpu")))
+	// the denying rule overlaps the requested filter
+	require.False(t, acl.Authorize(kid2.Pub, AccessSubscribe, []byte("#")))
+	require.False(t, acl.Authorize(kid2.Pub, AccessSubscribe, []byte("+/key")))
+
+	for _, bad := range []string{"default maybe", "allow publish *", "permit publish * a", "allow read * a", "allow publish xyz a", "allow publish * a/#/b"} {
+		_, err = ParseACL(strings.NewReader(bad))
+		require.Error(t, err, bad)
+	}
+	_, err = LoadACL(filepath.Join(t.TempDir(), "none.conf"))
+	require.Error(t, err)
+
+	require.True(t, coverTopic([]byte("a/#"), []byte("a/+/c")))
+	require.False(t, coverTopic([]byte("a/+"), []byte("a/#")))
+	require.True(t, overlapTopic([]byte("a/+/c"), []byte("+/b/#")))
+	require.False(t, overlapTopic([]byte("a/b"), []byte("a/b/c")))
+}
+
+func TestWorkersWithACL(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		err := tt.Close()
+		require.NoError(t, err)
+	}()
+
+	twp := NewTwinsPool()
+	defer twp.Close()
+
+	sw := NewSubscribeWorker(twp, tt)
+	defer sw.Close()
+
+	bKid, err1 := generateKadId()
+	require.NoError(t, err1)
+	kid1, err2 := generateKadId()
+	require.NoError(t, err2)
+
+	pw := NewPublishWorker(bKid, tt)
+	defer pw.Close()
+
+	acl := NewACL(false,
+		ACLRule{Allow: true, Any: true, Action: AccessSubscribe, Filter: []byte("/public/#")},
+		ACLRule{Allow: true, PubKey: kid1.Pub, Action: AccessPublish, Filter: []byte("/public/#")},
+	)
+	var denials []*AccessDenial
+	handler := func(ad *AccessDenial) { denials = append(denials, ad) }
+	sw.SetAuthorizer(acl, handler)
+	pw.SetAuthorizer(acl, handler)
+
+	var prd1 TwinServiceProvider = &provider{kadId: kid1}
+	result := <-sw.PeerNodeSubscribe(&prd1, byte(0), []byte("/public/news"))
+	require.NoError(t, result.Err)
+	result = <-sw.PeerNodeSubscribe(&prd1, byte(0), []byte("/private/news"))
+	require.Equal(t, AckNotAuthorized, result.Code)
+	require.Equal(t, uint32(1), sw.azDenNum)
+	require.Equal(t, uint32(1), sw.subErrNum)
+
+	pkt := NewMessagePacket(kid1, uint32(1), byte(0), []byte("/private/news"), []byte("xyz"))
+	defer pkt.Release()
+	require.Equal(t, ErrNotAuthorized, pw.WorkFor(pkt))
+	require.NoError(t, pw.WorkFor(NewMessagePacket(kid1, uint32(2), byte(0), []byte("/public/news"), []byte("xyz"))))
+	pw.Wait()
+	sw.Wait()
+	require.Equal(t, uint32(1), pw.azDenNum)
+
+	require.Equal(t, 2, len(denials))
+	require.Equal(t, AccessSubscribe, denials[0].Action)
+	require.Equal(t, AccessPublish, denials[1].Action)
+	require.Equal(t, kid1.Pub, denials[1].PubKey)
+	require.Equal(t, []byte("/private/news"), denials[1].Topic)
+}
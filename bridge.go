@@ -0,0 +1,154 @@
+package marina
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lithdew/kademlia"
+)
+
+// The publisher on the destination broker of the bridge, e.g. the PublishWorker, or the client of the remote broker.
+// The message-packets keep the KadId of the origin broker.
+type Publisher interface {
+	WorkForBridged(pkt *MessagePacket) error
+}
+
+var _ Publisher = (*PublishWorker)(nil)
+
+// The rule of the bridge, the topics matched by the filter are forwarded to the destination broker.
+// The topic starting with the From prefix is republished with the To prefix instead, the nil From keeps the topic.
+type BridgeRule struct {
+	Filter []byte
+	Qos    byte
+	From   []byte
+	To     []byte
+}
+
+// Return the topic on the destination broker.
+func (br *BridgeRule) remap(topic []byte) []byte {
+	if br.From == nil || !bytes.HasPrefix(topic, br.From) {
+		return topic
+	}
+	dst := make([]byte, 0, len(br.To)+len(topic)-len(br.From))
+	dst = append(dst, br.To...)
+	return append(dst, topic[len(br.From):]...)
+}
+
+// The bridge subscribes the topic filters on the source broker as one peer-node with its own KadID,
+// and republishes the message-packets on the destination broker by the publisher.
+// The message-packets keep the KadID of the origin broker, and the ones originated from the destination broker
+// are dropped, so that the bridges in both directions or in the cycle never loop.
+type Bridge struct {
+	kadId    *kademlia.ID        // the KadID of the bridge as the peer-node of the source broker
+	prd      TwinServiceProvider // the provider of the bridge's twin on the source broker
+	sw       *SubscribeWorker    // the subscribe worker of the source broker
+	dstKadId *kademlia.ID        // the KadID of the destination broker
+	dst      Publisher
+
+	fwdSucNum uint32 // the success count of the forwarding operation
+	fwdErrNum uint32 // the error count of the forwarding operation
+	loopNum   uint32 // the dropped count of the loop prevention
+
+	mu    sync.RWMutex
+	rules []BridgeRule
+}
+
+func NewBridge(kadId *kademlia.ID, sw *SubscribeWorker, dstKadId *kademlia.ID, dst Publisher) *Bridge {
+	b := &Bridge{
+		kadId:     kadId,
+		sw:        sw,
+		dstKadId:  dstKadId,
+		dst:       dst,
+		fwdSucNum: 0,
+		fwdErrNum: 0,
+		loopNum:   0,
+		mu:        sync.RWMutex{},
+	}
+	b.prd = &bridgeProvider{b: b}
+	return b
+}
+
+// Subscribe the filter of the rule on the source broker, the earlier rule wins for remapping the overlapping topics.
+// The retain flag of the message-packets is kept across the bridge.
+// The bridge is paired as one provider of the source broker, return the *QuotaError if the pool has no room for it.
+func (b *Bridge) AddRule(rule BridgeRule) error {
+	if _, err := b.sw.twp.appendProviders(&b.prd); err != nil {
+		return err
+	}
+	rule.Filter = append([]byte(nil), rule.Filter...)
+	sub := Subscription{Topic: rule.Filter, Qos: rule.Qos, RetainAsPublished: true}
+	if result := <-b.sw.PeerNodeSubscribeWithOptions(&b.prd, sub); result.Err != nil {
+		return result.Err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rules = append(b.rules, rule)
+	return nil
+}
+
+// Return the topic on the destination broker by the first matched rule.
+func (b *Bridge) remap(topic []byte) []byte {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for i := range b.rules {
+		if MatchTopic(b.rules[i].Filter, topic) {
+			return b.rules[i].remap(topic)
+		}
+	}
+	return topic
+}
+
+// Republish the message-packet on the destination broker, unless it has come from there.
+func (b *Bridge) forward(pkt *MessagePacket) error {
+	if origin := pkt.originBrokerKadId(); origin != nil && b.dstKadId != nil && origin.Pub == b.dstKadId.Pub {
+		atomic.AddUint32(&b.loopNum, uint32(1))
+		pkt.Release()
+		return nil
+	}
+
+	pkt.mu.Lock()
+	pkt.topic = b.remap(pkt.topic)
+	pkt.subKadId = nil
+	pkt.sid = 0
+	pkt.mu.Unlock()
+
+	if err := b.dst.WorkForBridged(pkt); err != nil {
+		atomic.AddUint32(&b.fwdErrNum, uint32(1))
+		pkt.Release()
+		return err
+	}
+	atomic.AddUint32(&b.fwdSucNum, uint32(1))
+	return nil
+}
+
+// Unsubscribe all the filters on the source broker, and remove the provider of the bridge from the twins pool.
+func (b *Bridge) Close() {
+	<-b.sw.UnsubscribeAll(b.kadId.Pub)
+	b.sw.twp.removeProviders(&b.prd)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rules = nil
+}
+
+// The provider of the bridge's twin, which decodes the message-packets for the forwarding.
+type bridgeProvider struct {
+	b *Bridge
+}
+
+func (bp *bridgeProvider) KadID() *kademlia.ID {
+	return bp.b.kadId
+}
+
+func (bp *bridgeProvider) Push(data []byte) error {
+	pkt, err := UnmarshalMessagePacket(data)
+	if err != nil {
+		return err
+	}
+	return bp.b.forward(pkt)
+}
@@ -0,0 +1,142 @@
+package marina
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TheSmallBoat/cabinet"
+	"github.com/lithdew/kademlia"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+// The broker with the workers for the bridging test.
+type testBroker struct {
+	kadId *kademlia.ID
+	tt    *cabinet.TTree
+	twp   *TwinsPool
+	sw    *SubscribeWorker
+	pw    *PublishWorker
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	kid, err := generateKadId()
+	require.NoError(t, err)
+
+	tt := cabinet.NewTopicTree()
+	twp := NewTwinsPool()
+	return &testBroker{
+		kadId: kid,
+		tt:    tt,
+		twp:   twp,
+		sw:    NewSubscribeWorker(twp, tt),
+		pw:    NewPublishWorker(kid, tt),
+	}
+}
+
+func (tb *testBroker) close(t *testing.T) {
+	tb.pw.Close()
+	tb.sw.Close()
+	tb.twp.Close()
+	require.NoError(t, tb.tt.Close())
+}
+
+func TestBridgeRuleRemap(t *testing.T) {
+	br := BridgeRule{Filter: []byte("/sensor/#"), From: []byte("/sensor"), To: []byte("/site/a/sensor")}
+	require.Equal(t, []byte("/site/a/sensor/t1"), br.remap([]byte("/sensor/t1")))
+	require.Equal(t, []byte("/alarm"), br.remap([]byte("/alarm")))
+
+	br = BridgeRule{Filter: []byte("#")}
+	require.Equal(t, []byte("/sensor/t1"), br.remap([]byte("/sensor/t1")))
+}
+
+func TestBridge(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	brkA, brkB := newTestBroker(t), newTestBroker(t)
+	defer brkA.close(t)
+	defer brkB.close(t)
+
+	gate := make(chan struct{})
+	close(gate)
+	sKidA, err := generateKadId()
+	require.NoError(t, err)
+	sKidB, err := generateKadId()
+	require.NoError(t, err)
+	gpA := &gatedProvider{kadId: sKidA, gate: gate}
+	gpB := &gatedProvider{kadId: sKidB, gate: gate}
+	var prdA TwinServiceProvider = gpA
+	var prdB TwinServiceProvider = gpB
+	_, err = brkA.twp.appendProviders(&prdA)
+	require.NoError(t, err)
+	_, err = brkB.twp.appendProviders(&prdB)
+	require.NoError(t, err)
+	require.NoError(t, (<-brkA.sw.PeerNodeSubscribe(&prdA, byte(0), []byte("#"))).Err)
+	require.NoError(t, (<-brkB.sw.PeerNodeSubscribeWithOptions(&prdB, Subscription{Topic: []byte("#"), RetainAsPublished: true})).Err)
+
+	// the bridges in both directions, the one from A to B remaps the topics
+	kidAB, err := generateKadId()
+	require.NoError(t, err)
+	kidBA, err := generateKadId()
+	require.NoError(t, err)
+	ab := NewBridge(kidAB, brkA.sw, brkB.kadId, brkB.pw)
+	require.NoError(t, ab.AddRule(BridgeRule{Filter: []byte("/sensor/#"), From: []byte("/sensor"), To: []byte("/site/a/sensor")}))
+	ba := NewBridge(kidBA, brkB.sw, brkA.kadId, brkA.pw)
+	require.NoError(t, ba.AddRule(BridgeRule{Filter: []byte("#")}))
+	require.True(t, errors.Is(ab.AddRule(BridgeRule{Filter: []byte("/sensor/#/t1")}), ErrInvalidTopicFilter))
+
+	// the twins of the bridges are paired with their providers, and kept by the reconciling
+	brkA.twp.reconcile()
+	brkB.twp.reconcile()
+	twAB, exist := brkA.twp.existTwin(kidAB.Pub)
+	require.True(t, exist)
+	require.True(t, twAB.onlineStatus())
+	twBA, exist := brkB.twp.existTwin(kidBA.Pub)
+	require.True(t, exist)
+	require.True(t, twBA.onlineStatus())
+
+	pKid, err := generateKadId()
+	require.NoError(t, err)
+	pkt := NewMessagePacket(pKid, uint32(1), byte(0), []byte("/sensor/t1"), []byte("21.5"))
+	pkt.SetRetain(true)
+	require.NoError(t, brkA.pw.WorkFor(pkt))
+
+	// A -> B, and the way back to A is dropped
+	require.Eventually(t, func() bool { return atomic.LoadUint32(&ba.loopNum) == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, uint32(1), atomic.LoadUint32(&ab.fwdSucNum))
+	require.Equal(t, uint32(0), atomic.LoadUint32(&ba.fwdSucNum))
+	require.Eventually(t, func() bool { return len(gpB.received()) == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, 1, len(gpA.received()))
+
+	rsp, err := UnmarshalMessagePacket(gpB.received()[0])
+	require.NoError(t, err)
+	require.Equal(t, []byte("/site/a/sensor/t1"), rsp.topic)
+	require.Equal(t, []byte("21.5"), rsp.payLoad)
+	require.Equal(t, pKid.Pub, rsp.pubKadId.Pub)
+	require.Equal(t, brkA.kadId.Pub, rsp.brkKadId.Pub)
+	require.True(t, rsp.retain)
+	rsp.Release()
+
+	// B -> A, which is not matched by the bridge from A to B, and the origin broker claimed by the peer-node is replaced
+	pkt = NewMessagePacket(pKid, uint32(2), byte(0), []byte("/alarm"), []byte("fire"))
+	pkt.SetBrokerKadId(brkA.kadId)
+	require.NoError(t, brkB.pw.WorkFor(pkt))
+	require.Eventually(t, func() bool { return len(gpA.received()) == 2 }, time.Second, time.Millisecond)
+	require.Equal(t, uint32(1), atomic.LoadUint32(&ba.fwdSucNum))
+	rsp, err = UnmarshalMessagePacket(gpA.received()[1])
+	require.NoError(t, err)
+	require.Equal(t, []byte("/alarm"), rsp.topic)
+	require.Equal(t, brkB.kadId.Pub, rsp.brkKadId.Pub)
+	rsp.Release()
+
+	ab.Close()
+	ba.Close()
+	require.Empty(t, brkA.twp.SubscriptionsOf(kidAB.Pub))
+	require.Empty(t, brkB.twp.SubscriptionsOf(kidBA.Pub))
+	_, exist = brkA.twp.existServiceProvider(kidAB.Pub)
+	require.False(t, exist)
+	brkA.pw.Wait()
+	brkB.pw.Wait()
+}
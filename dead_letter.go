@@ -0,0 +1,155 @@
+package marina
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/lithdew/bytesutil"
+	"github.com/lithdew/kademlia"
+)
+
+// The reason why the message-packet cannot be delivered.
+type DeadLetterReason byte
+
+const (
+	DeadLetterNoSubscriber  DeadLetterReason = iota + 1 // No subscriber matched the topic.
+	DeadLetterTwinOffline                               // The twin of the subscriber is offline.
+	DeadLetterPushFailed                                // The provider of the subscriber failed to push, after all of the retries.
+	DeadLetterQuotaExceeded                             // The twin of the subscriber has queued too many bytes.
+	DeadLetterOverflow                                  // The channel of the twin is full, and the data is dropped by the overflow policy.
+)
+
+func (r DeadLetterReason) String() string {
+	switch r {
+	case DeadLetterNoSubscriber:
+		return "no subscriber"
+	case DeadLetterTwinOffline:
+		return "twin offline"
+	case DeadLetterPushFailed:
+		return "push failed"
+	case DeadLetterQuotaExceeded:
+		return "quota exceeded"
+	case DeadLetterOverflow:
+		return "overflow"
+	default:
+		return "unknown"
+	}
+}
+
+type DeadLetter struct {
+	Reason DeadLetterReason
+	Err    error
+	Time   time.Time
+	KadID  *kademlia.ID // The subscribe-peer-node KadId, nil if no subscriber matched.
+	Data   []byte       // The encoded message-packet with the original metadata, to be decoded by the UnmarshalMessagePacket.
+}
+
+// The handler for the dead letters, which must not block.
+type DeadLetterHandler func(dl *DeadLetter)
+
+func newDeadLetter(reason DeadLetterReason, err error, kadId *kademlia.ID, data []byte) *DeadLetter {
+	return &DeadLetter{
+		Reason: reason,
+		Err:    err,
+		Time:   time.Now(),
+		KadID:  kadId,
+		Data:   data,
+	}
+}
+
+// Decode the original message-packet, for inspecting or replaying.
+func (dl *DeadLetter) Packet() (*MessagePacket, error) {
+	return UnmarshalMessagePacket(dl.Data)
+}
+
+func (dl *DeadLetter) AppendTo(dst []byte) []byte {
+	var msg string
+	if dl.Err != nil {
+		msg = dl.Err.Error()
+	}
+	if len(msg) > math.MaxUint16 {
+		msg = msg[:math.MaxUint16]
+	}
+
+	dst = append(dst, byte(dl.Reason))
+	dst = bytesutil.AppendUint64BE(dst, uint64(dl.Time.UnixNano()))
+	dst = bytesutil.AppendUint16BE(dst, uint16(len(msg)))
+	dst = append(dst, msg...)
+	dst = bytesutil.AppendUint32BE(dst, uint32(len(dl.Data)))
+	dst = append(dst, dl.Data...)
+	return dst
+}
+
+func UnmarshalDeadLetter(buf []byte) (*DeadLetter, error) {
+	dl := &DeadLetter{}
+
+	if len(buf) < 11 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	dl.Reason, buf = DeadLetterReason(buf[0]), buf[1:]
+	dl.Time, buf = time.Unix(0, int64(bytesutil.Uint64BE(buf[:8]))), buf[8:]
+
+	size, buf := int(bytesutil.Uint16BE(buf[:2])), buf[2:]
+	if len(buf) < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if size > 0 {
+		dl.Err = errors.New(string(buf[:size]))
+	}
+	buf = buf[size:]
+
+	if len(buf) < 4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	size, buf = int(bytesutil.Uint32BE(buf[:4])), buf[4:]
+	if len(buf) < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	dl.Data = buf[:size]
+
+	pkt, err := dl.Packet()
+	if err != nil {
+		return nil, err
+	}
+	dl.KadID = pkt.subKadId
+	if dl.KadID.Pub.Zero() {
+		dl.KadID = nil
+	}
+	pkt.Release()
+
+	return dl, nil
+}
+
+// Return the handler that republishes the encoded dead letters to the topic through the publish worker.
+// The dead letter goes to the topic in the namespace of the original publisher's tenant, so that the tenants
+// never see the dead letters of the others.
+// The dead letters of the topic itself are discarded to avoid the loop, and so are the ones
+// that are too large for one message-packet or while the publish worker is too busy, which are counted as dropped.
+func NewDeadLetterTopic(pw *PublishWorker, topic []byte) DeadLetterHandler {
+	topic = append([]byte(nil), topic...)
+	mid := uint32(0)
+
+	return func(dl *DeadLetter) {
+		pkt, err := dl.Packet()
+		if err != nil {
+			return
+		}
+		loop := bytes.Equal(pkt.topic, topic)
+		tn := pw.tenantOf(pkt)
+		pkt.Release()
+		if loop {
+			return
+		}
+
+		payLoad := dl.AppendTo(nil)
+		if len(payLoad) > math.MaxUint16 {
+			atomic.AddUint32(&pw.dlDrpNum, uint32(1))
+			return
+		}
+		pw.republish(NewMessagePacket(pw.kadId, atomic.AddUint32(&mid, uint32(1)), zeroQos, topic, payLoad), tn)
+	}
+}
@@ -0,0 +1,210 @@
+package marina
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TheSmallBoat/cabinet"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestDeadLetter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	pKid, err1 := generateKadId()
+	require.NoError(t, err1)
+	sKid, err2 := generateKadId()
+	require.NoError(t, err2)
+
+	require.Equal(t, "no subscriber", DeadLetterNoSubscriber.String())
+	require.Equal(t, "twin offline", DeadLetterTwinOffline.String())
+	require.Equal(t, "push failed", DeadLetterPushFailed.String())
+	require.Equal(t, "quota exceeded", DeadLetterQuotaExceeded.String())
+	require.Equal(t, "overflow", DeadLetterOverflow.String())
+	require.Equal(t, "unknown", DeadLetterReason(0).String())
+
+	pkt := NewMessagePacket(pKid, uint32(88), byte(1), []byte("/finance/tom"), []byte("xyz123456abc"))
+	pkt.SetSubscriberKadId(sKid)
+	dl := newDeadLetter(DeadLetterPushFailed, errors.New("broken pipe"), sKid, pkt.AppendTo(nil))
+	pkt.Release()
+
+	buf := dl.AppendTo(nil)
+	dl_, err := UnmarshalDeadLetter(buf)
+	require.NoError(t, err)
+	require.Equal(t, dl.Reason, dl_.Reason)
+	require.Equal(t, dl.Err.Error(), dl_.Err.Error())
+	require.Equal(t, dl.Time.UnixNano(), dl_.Time.UnixNano())
+	require.Equal(t, dl.Data, dl_.Data)
+	require.Equal(t, sKid.Pub, dl_.KadID.Pub)
+
+	pkt_, err := dl_.Packet()
+	require.NoError(t, err)
+	require.Equal(t, uint32(88), pkt_.mid)
+	require.Equal(t, []byte("/finance/tom"), pkt_.topic)
+	require.Equal(t, pKid.Pub, pkt_.pubKadId.Pub)
+	pkt_.Release()
+
+	// without the error and the subscriber
+	pkt = NewMessagePacket(pKid, uint32(89), byte(0), []byte("/finance/tom"), []byte("xyz"))
+	dl = newDeadLetter(DeadLetterNoSubscriber, nil, nil, pkt.AppendTo(nil))
+	pkt.Release()
+	dl_, err = UnmarshalDeadLetter(dl.AppendTo(nil))
+	require.NoError(t, err)
+	require.Nil(t, dl_.Err)
+	require.Nil(t, dl_.KadID)
+
+	for _, n := range []int{4, 12, 16, 20, len(buf) - 1} {
+		_, err = UnmarshalDeadLetter(buf[:n])
+		require.Error(t, err)
+	}
+	_, err = UnmarshalDeadLetter(append(buf[:11], 0, 0, 0, 0, 0, 1, 0))
+	require.Error(t, err)
+}
+
+func TestDeadLetterTopic(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		err := tt.Close()
+		require.NoError(t, err)
+	}()
+
+	pKid, err1 := generateKadId()
+	require.NoError(t, err1)
+	bKid, err2 := generateKadId()
+	require.NoError(t, err2)
+	sKid, err3 := generateKadId()
+	require.NoError(t, err3)
+	oKid, err4 := generateKadId()
+	require.NoError(t, err4)
+
+	twp := NewTwinsPool()
+	defer twp.Close()
+
+	gp := &gatedProvider{kadId: sKid, gate: make(chan struct{})}
+	close(gp.gate)
+	var prd TwinServiceProvider = gp
+	require.NoError(t, tt.EntityLink([]byte("/dead/letter"), twp.acquire(&prd)))
+
+	var oPrd TwinServiceProvider = &provider{kadId: oKid}
+	oTw := twp.acquire(&oPrd)
+	require.NoError(t, tt.EntityLink([]byte("/finance/jack"), oTw))
+	oTw.turnToOffline()
+
+	pw := NewPublishWorker(bKid, tt)
+	defer pw.Close()
+	pw.SetDeadLetterHandler(NewDeadLetterTopic(pw, []byte("/dead/letter")))
+
+	// no subscriber
+	require.NoError(t, pw.WorkFor(NewMessagePacket(pKid, uint32(1), byte(0), []byte("/finance/tom"), []byte("xyz"))))
+	require.Eventually(t, func() bool { return len(gp.received()) == 1 }, time.Second, time.Millisecond)
+	pw.Wait()
+
+	pkt, err := UnmarshalMessagePacket(gp.received()[0])
+	require.NoError(t, err)
+	require.Equal(t, []byte("/dead/letter"), pkt.topic)
+	require.Equal(t, bKid.Pub, pkt.pubKadId.Pub)
+	dl, err := UnmarshalDeadLetter(pkt.payLoad)
+	require.NoError(t, err)
+	require.Equal(t, DeadLetterNoSubscriber, dl.Reason)
+	require.Nil(t, dl.KadID)
+	pkt_, err := dl.Packet()
+	require.NoError(t, err)
+	require.Equal(t, []byte("/finance/tom"), pkt_.topic)
+	require.Equal(t, pKid.Pub, pkt_.pubKadId.Pub)
+
+	// the offline twin
+	require.NoError(t, pw.WorkFor(NewMessagePacket(pKid, uint32(2), byte(0), []byte("/finance/jack"), []byte("xyz"))))
+	require.Eventually(t, func() bool { return len(gp.received()) == 2 }, time.Second, time.Millisecond)
+	pw.Wait()
+
+	pkt, err = UnmarshalMessagePacket(gp.received()[1])
+	require.NoError(t, err)
+	dl, err = UnmarshalDeadLetter(pkt.payLoad)
+	require.NoError(t, err)
+	require.Equal(t, DeadLetterTwinOffline, dl.Reason)
+	require.Equal(t, oKid.Pub, dl.KadID.Pub)
+
+	// no loop for the dead-letter topic itself
+	require.NoError(t, tt.EntityUnLink([]byte("/dead/letter"), twp.acquire(&prd)))
+	require.NoError(t, pw.WorkFor(NewMessagePacket(pKid, uint32(3), byte(0), []byte("/finance/tom"), []byte("xyz"))))
+	pw.Wait()
+	require.Equal(t, uint32(3), pw.pubErrNum)
+	require.Equal(t, 2, len(gp.received()))
+}
+
+func TestDeadLetterTopicRepublishWhileWaiting(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		err := tt.Close()
+		require.NoError(t, err)
+	}()
+
+	pKid, err1 := generateKadId()
+	require.NoError(t, err1)
+	bKid, err2 := generateKadId()
+	require.NoError(t, err2)
+	sKid, err3 := generateKadId()
+	require.NoError(t, err3)
+
+	twp := NewTwinsPool()
+	defer twp.Close()
+
+	gp := &gatedProvider{kadId: sKid, gate: make(chan struct{})}
+	close(gp.gate)
+	var prd TwinServiceProvider = gp
+	require.NoError(t, tt.EntityLink([]byte("/dead/letter"), twp.acquire(&prd)))
+
+	pw := NewPublishWorker(bKid, tt)
+	defer pw.Close()
+	handler := NewDeadLetterTopic(pw, []byte("/dead/letter"))
+
+	// the dead letters come from the twins at any time, even while waiting for the publish worker
+	pkt := NewMessagePacket(pKid, uint32(1), byte(0), []byte("/finance/tom"), []byte("xyz"))
+	data := pkt.AppendTo(nil)
+	pkt.Release()
+
+	num := 200
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < num/4; j++ {
+				handler(newDeadLetter(DeadLetterPushFailed, errors.New("broken pipe"), sKid, data))
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for waiting := true; waiting; {
+		select {
+		case <-done:
+			waiting = false
+		default:
+			pw.Wait()
+		}
+	}
+	pw.Wait()
+
+	// the republished dead letters have been forwarded, the others have been counted as dropped
+	forwarded := int(atomic.LoadUint32(&pw.pubSucNum))
+	require.Equal(t, num, forwarded+int(atomic.LoadUint32(&pw.dlDrpNum)))
+	require.Eventually(t, func() bool { return len(gp.received()) == forwarded }, time.Second, time.Millisecond)
+
+	// the dead letter too large for one message-packet is dropped
+	handler(newDeadLetter(DeadLetterPushFailed, errors.New(string(make([]byte, math.MaxUint16))), sKid, data))
+	pw.Wait()
+	require.Equal(t, num+1, forwarded+int(atomic.LoadUint32(&pw.dlDrpNum)))
+}
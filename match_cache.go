@@ -0,0 +1,144 @@
+package marina
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const defaultMaxMatchCacheEntries = 4096
+
+// The decorator of the topic index, which caches the matched subscribers of the topics for publishing.
+// The entries are invalidated by the linking and the unlinking of the matched filters,
+// and the hot topics are matched without any allocation.
+type MatchCache struct {
+	ti TopicIndex
+
+	mu  sync.RWMutex
+	mpe map[string]*matchEntry
+	max int
+	gen uint64 // The generation of the links, increased by every linking and unlinking.
+
+	hitNum  uint32 // the hit count of the matching operation
+	missNum uint32 // the miss count of the matching operation
+}
+
+// The matched subscribers of one topic, immutable after cached.
+type matchEntry struct {
+	twins    []*twin
+	groups   []*shareGroup
+	entities []interface{} // The entities of the other types.
+}
+
+func (me *matchEntry) length() int {
+	return len(me.twins) + len(me.groups) + len(me.entities)
+}
+
+var _ typedMatcher = (*MatchCache)(nil)
+
+// Wrap the topic index with the cache of the max entries, the non-positive max means the default.
+func NewMatchCache(ti TopicIndex, maxEntries int) *MatchCache {
+	if maxEntries < 1 {
+		maxEntries = defaultMaxMatchCacheEntries
+	}
+	return &MatchCache{
+		ti:  ti,
+		mu:  sync.RWMutex{},
+		mpe: make(map[string]*matchEntry),
+		max: maxEntries,
+	}
+}
+
+func (mc *MatchCache) EntityLink(topic []byte, entity interface{}) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	err := mc.ti.EntityLink(topic, entity)
+	mc.invalidate(topic)
+	return err
+}
+
+func (mc *MatchCache) EntityUnLink(topic []byte, entity interface{}) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	err := mc.ti.EntityUnLink(topic, entity)
+	mc.invalidate(topic)
+	return err
+}
+
+// Remove the entries matched by the filter, the caller holds the lock.
+func (mc *MatchCache) invalidate(filter []byte) {
+	mc.gen++
+	for topic := range mc.mpe {
+		if MatchTopic(filter, []byte(topic)) {
+			delete(mc.mpe, topic)
+		}
+	}
+}
+
+func (mc *MatchCache) LinkedEntities(topic []byte, entities *[]interface{}) error {
+	me, err := mc.match(topic)
+	if err != nil {
+		return err
+	}
+
+	*entities = (*entities)[0:0]
+	for _, tw := range me.twins {
+		*entities = append(*entities, tw)
+	}
+	for _, sg := range me.groups {
+		*entities = append(*entities, sg)
+	}
+	*entities = append(*entities, me.entities...)
+	return nil
+}
+
+// Return the cached entry of the topic, or match it by the topic index and cache it.
+func (mc *MatchCache) match(topic []byte) (*matchEntry, error) {
+	mc.mu.RLock()
+	me, exist := mc.mpe[string(topic)]
+	gen := mc.gen
+	mc.mu.RUnlock()
+
+	if exist {
+		atomic.AddUint32(&mc.hitNum, uint32(1))
+		return me, nil
+	}
+	atomic.AddUint32(&mc.missNum, uint32(1))
+
+	entities := make([]interface{}, 0)
+	if err := mc.ti.LinkedEntities(topic, &entities); err != nil {
+		return nil, err
+	}
+	me = &matchEntry{}
+	for _, e := range entities {
+		switch v := e.(type) {
+		case *twin:
+			me.twins = append(me.twins, v)
+		case *shareGroup:
+			me.groups = append(me.groups, v)
+		default:
+			me.entities = append(me.entities, v)
+		}
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	// The entry is stale if the links have been changed while matching.
+	if mc.gen == gen {
+		if len(mc.mpe) >= mc.max {
+			mc.mpe = make(map[string]*matchEntry)
+		}
+		mc.mpe[string(topic)] = me
+	}
+	return me, nil
+}
+
+func (mc *MatchCache) Close() error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	mc.mpe = make(map[string]*matchEntry)
+	return mc.ti.Close()
+}
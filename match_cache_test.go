@@ -0,0 +1,122 @@
+package marina
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheSmallBoat/cabinet"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestMatchCache(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	mc := NewMatchCache(cabinet.NewTopicTree(), 0)
+	defer func() {
+		err := mc.Close()
+		require.NoError(t, err)
+	}()
+
+	twp := NewTwinsPool()
+	defer twp.Close()
+
+	sw := NewSubscribeWorker(twp, mc)
+	defer sw.Close()
+
+	pKid, err1 := generateKadId()
+	require.NoError(t, err1)
+	bKid, err2 := generateKadId()
+	require.NoError(t, err2)
+	sKid1, err3 := generateKadId()
+	require.NoError(t, err3)
+	sKid2, err4 := generateKadId()
+	require.NoError(t, err4)
+
+	pw := NewPublishWorker(bKid, mc)
+	defer pw.Close()
+
+	gate := make(chan struct{})
+	close(gate)
+	gp1 := &gatedProvider{kadId: sKid1, gate: gate}
+	gp2 := &gatedProvider{kadId: sKid2, gate: gate}
+	var prd1 TwinServiceProvider = gp1
+	var prd2 TwinServiceProvider = gp2
+
+	require.NoError(t, (<-sw.PeerNodeSubscribe(&prd1, byte(0), []byte("telemetry/+/cpu"))).Err)
+	require.Equal(t, 1, pw.EntitiesNumFor([]byte("telemetry/a/cpu")))
+	require.Equal(t, 1, pw.EntitiesNumFor([]byte("telemetry/a/cpu")))
+	require.Equal(t, uint32(1), mc.missNum)
+	require.Equal(t, uint32(1), mc.hitNum)
+
+	// The hot topic is matched without any allocation.
+	topic := []byte("telemetry/a/cpu")
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _ = mc.match(topic)
+	})
+	require.Equal(t, float64(0), allocs)
+
+	// The subscribing invalidates the matched entries only.
+	require.Equal(t, 0, pw.EntitiesNumFor([]byte("alarm/fire")))
+	require.NoError(t, (<-sw.PeerNodeSubscribe(&prd2, byte(0), []byte("telemetry/#"))).Err)
+	require.Equal(t, 1, len(mc.mpe))
+	require.Equal(t, 2, pw.EntitiesNumFor([]byte("telemetry/a/cpu")))
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, pw.WorkFor(NewMessagePacket(pKid, uint32(i), byte(0), []byte("telemetry/a/cpu"), []byte("xyz"))))
+	}
+	pw.Wait()
+	require.Eventually(t, func() bool {
+		return len(gp1.received()) == 10 && len(gp2.received()) == 10
+	}, time.Second, time.Millisecond)
+
+	// The unsubscribing invalidates the entries too.
+	require.NoError(t, (<-sw.PeerNodeUnSubscribe(sKid1.Pub, byte(0), []byte("telemetry/+/cpu"))).Err)
+	require.Equal(t, 1, pw.EntitiesNumFor([]byte("telemetry/a/cpu")))
+	require.NoError(t, (<-sw.PeerNodeUnSubscribe(sKid2.Pub, byte(0), []byte("telemetry/#"))).Err)
+	require.Equal(t, 0, pw.EntitiesNumFor([]byte("telemetry/a/cpu")))
+	sw.Wait()
+}
+
+// The topic index embedding the match cache, which keeps the typed matching.
+type wrappedMatchCache struct {
+	*MatchCache
+}
+
+func TestMatchCacheWrapped(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	mc := NewMatchCache(cabinet.NewTopicTree(), 0)
+	wmc := wrappedMatchCache{MatchCache: mc}
+	defer func() {
+		err := wmc.Close()
+		require.NoError(t, err)
+	}()
+
+	twp := NewTwinsPool()
+	defer twp.Close()
+	sw := NewSubscribeWorker(twp, wmc)
+	defer sw.Close()
+
+	bKid, err := generateKadId()
+	require.NoError(t, err)
+	sKid, err := generateKadId()
+	require.NoError(t, err)
+	pw := NewPublishWorker(bKid, wmc)
+	defer pw.Close()
+
+	gate := make(chan struct{})
+	close(gate)
+	gp := &gatedProvider{kadId: sKid, gate: gate}
+	var prd TwinServiceProvider = gp
+	require.NoError(t, (<-sw.PeerNodeSubscribe(&prd, byte(0), []byte("telemetry/#"))).Err)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, pw.WorkFor(NewMessagePacket(bKid, uint32(i), byte(0), []byte("telemetry/a/cpu"), []byte("xyz"))))
+		pw.Wait()
+	}
+	require.Eventually(t, func() bool { return len(gp.received()) == 3 }, time.Second, time.Millisecond)
+	require.Equal(t, uint32(1), mc.missNum)
+	require.Equal(t, uint32(2), mc.hitNum)
+	sw.Wait()
+}
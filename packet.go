@@ -8,6 +8,15 @@ import (
 	"github.com/lithdew/kademlia"
 )
 
+// The priority of the message-packet, the high-priority packets overtake the low-priority ones
+// in the task pool and in the twins.
+type Priority byte
+
+const (
+	PriorityLow Priority = iota
+	PriorityHigh
+)
+
 type MessagePacket struct {
 	mu sync.Mutex
 
@@ -15,10 +24,16 @@ type MessagePacket struct {
 	brkKadId *kademlia.ID // the broker-peer-node KadId
 	subKadId *kademlia.ID // the subscribe-peer-node KadId
 
-	mid     uint32 // the number of the message-packet by the creator
-	qos     byte
-	topic   []byte
-	payLoad []byte
+	mid      uint32 // the number of the message-packet by the creator
+	qos      byte
+	topic    []byte
+	payLoad  []byte
+	retain   bool   // the retain flag by the publisher
+	sid      uint32 // the subscription identifier for the subscriber, zero means none
+	rspTopic []byte // the topic for the response of the request, nil means no response expected
+	corData  []byte // the correlation data for matching the response with the request
+
+	priority Priority // the delivery priority inside the broker, not transmitted
 }
 
 func NewMessagePacket(pubKadId *kademlia.ID, mid uint32, qos byte, topic []byte, payLoad []byte) *MessagePacket {
@@ -32,6 +47,27 @@ func (mp *MessagePacket) SetBrokerKadId(kadId *kademlia.ID) {
 	mp.brkKadId = kadId
 }
 
+// Set the broker KadId only if absent, the bridged message-packet keeps its origin broker for the loop prevention.
+func (mp *MessagePacket) setOriginBrokerKadId(kadId *kademlia.ID) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if mp.brkKadId == nil || mp.brkKadId.Pub == kademlia.ZeroID.Pub {
+		mp.brkKadId = kadId
+	}
+}
+
+// Return the origin broker KadId, nil if the message-packet has not been forwarded by any broker.
+func (mp *MessagePacket) originBrokerKadId() *kademlia.ID {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if mp.brkKadId == nil || mp.brkKadId.Pub == kademlia.ZeroID.Pub {
+		return nil
+	}
+	return mp.brkKadId
+}
+
 func (mp *MessagePacket) SetSubscriberKadId(kadId *kademlia.ID) {
 	mp.mu.Lock()
 	defer mp.mu.Unlock()
@@ -39,22 +75,101 @@ func (mp *MessagePacket) SetSubscriberKadId(kadId *kademlia.ID) {
 	mp.subKadId = kadId
 }
 
+func (mp *MessagePacket) SetRetain(retain bool) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	mp.retain = retain
+}
+
+// Set the topic for the response, the responder publishes the response to it.
+func (mp *MessagePacket) SetResponseTopic(topic []byte) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	mp.rspTopic = topic
+}
+
+func (mp *MessagePacket) ResponseTopic() []byte {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	return mp.rspTopic
+}
+
+// Set the correlation data, the responder carries it back in the response unchanged.
+func (mp *MessagePacket) SetCorrelationData(data []byte) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	mp.corData = data
+}
+
+func (mp *MessagePacket) CorrelationData() []byte {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	return mp.corData
+}
+
+func (mp *MessagePacket) SetPriority(priority Priority) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	mp.priority = priority
+}
+
 func (mp *MessagePacket) AppendTo(dst []byte) []byte {
 	mp.mu.Lock()
 	defer mp.mu.Unlock()
 
+	return mp.appendTo(dst, mp.qos, mp.retain, mp.sid)
+}
+
+// Append the message-packet for the subscriber by the subscription options,
+// the qos is downgraded to the maximum qos, and the retain flag is kept only if retain-as-published.
+func (mp *MessagePacket) appendForSubscription(dst []byte, sub *Subscription) []byte {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	qos := mp.qos
+	if qos > sub.Qos {
+		qos = sub.Qos
+	}
+	return mp.appendTo(dst, qos, mp.retain && sub.RetainAsPublished, sub.SubscriptionID)
+}
+
+func (mp *MessagePacket) appendTo(dst []byte, qos byte, retain bool, sid uint32) []byte {
 	dst = bytesutil.AppendUint32BE(dst, mp.mid)
-	dst = append(dst, mp.qos)
+	dst = append(dst, qos)
 	dst = bytesutil.AppendUint16BE(dst, uint16(len(mp.topic)))
 	dst = append(dst, mp.topic...)
 	dst = bytesutil.AppendUint16BE(dst, uint16(len(mp.payLoad)))
 	dst = append(dst, mp.payLoad...)
-	dst = mp.pubKadId.AppendTo(dst)
-	dst = mp.brkKadId.AppendTo(dst)
-	dst = mp.subKadId.AppendTo(dst)
+	dst = appendKadId(dst, mp.pubKadId)
+	dst = appendKadId(dst, mp.brkKadId)
+	dst = appendKadId(dst, mp.subKadId)
+	if retain {
+		dst = append(dst, byte(1))
+	} else {
+		dst = append(dst, byte(0))
+	}
+	dst = bytesutil.AppendUint32BE(dst, sid)
+	dst = bytesutil.AppendUint16BE(dst, uint16(len(mp.rspTopic)))
+	dst = append(dst, mp.rspTopic...)
+	dst = bytesutil.AppendUint16BE(dst, uint16(len(mp.corData)))
+	dst = append(dst, mp.corData...)
 	return dst
 }
 
+// The nil KadId would be encoded as the zero KadId.
+func appendKadId(dst []byte, kadId *kademlia.ID) []byte {
+	if kadId == nil {
+		return kademlia.ZeroID.AppendTo(dst)
+	}
+	return kadId.AppendTo(dst)
+}
+
 func UnmarshalMessagePacket(buf []byte) (*MessagePacket, error) {
 	var err error
 	var size uint16
@@ -102,12 +217,51 @@ func UnmarshalMessagePacket(buf []byte) (*MessagePacket, error) {
 		return nil, err
 	}
 
+	// The trailing groups are optional, for the peer-nodes and the bridges running the earlier formats.
+	var retain bool
+	var sid uint32
+	if len(buf) > 0 {
+		if len(buf) < 5 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		retain, sid, buf = buf[0] == byte(1), bytesutil.Uint32BE(buf[1:5]), buf[5:]
+	}
+
+	var rspTopic, corData []byte
+	if len(buf) > 0 {
+		if rspTopic, buf, err = unmarshalBytes(buf); err != nil {
+			return nil, err
+		}
+		if corData, _, err = unmarshalBytes(buf); err != nil {
+			return nil, err
+		}
+	}
+
 	pkt := NewMessagePacket(&pubKadId, mid, qos, topic, payLoad)
 	pkt.SetBrokerKadId(&brkKadId)
 	pkt.SetSubscriberKadId(&subKadId)
+	pkt.mu.Lock()
+	pkt.retain, pkt.sid = retain, sid
+	pkt.rspTopic, pkt.corData = rspTopic, corData
+	pkt.mu.Unlock()
 	return pkt, nil
 }
 
+// Return the bytes with the 16-bit length prefix, nil if empty.
+func unmarshalBytes(buf []byte) ([]byte, []byte, error) {
+	if len(buf) < 2 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	size, buf := bytesutil.Uint16BE(buf[:2]), buf[2:]
+	if uint16(len(buf)) < size {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	if size == 0 {
+		return nil, buf, nil
+	}
+	return buf[:size], buf[size:], nil
+}
+
 func (mp *MessagePacket) Release() {
 	theMessagePacketPool.release(mp)
 }
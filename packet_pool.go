@@ -45,6 +45,11 @@ func (mpp *messagePacketPool) release(mp *MessagePacket) {
 	mp.qos = zeroQos
 	mp.topic = nil
 	mp.payLoad = nil
+	mp.retain = false
+	mp.sid = 0
+	mp.rspTopic = nil
+	mp.corData = nil
+	mp.priority = PriorityLow
 	mp.mu.Unlock()
 
 	mpp.sp.Put(mp)
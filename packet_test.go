@@ -100,4 +100,56 @@ func TestPacket(t *testing.T) {
 	require.Equal(t, []byte("/finance/tom/#"), pkt.topic)
 	require.Equal(t, []byte("....xyz123456abc...."), pkt.payLoad)
 
+	// the retain flag and the subscription options
+	pkt.SetRetain(true)
+	pkt_, err = UnmarshalMessagePacket(pkt.AppendTo(nil))
+	require.NoError(t, err)
+	require.Equal(t, true, pkt_.retain)
+	require.Equal(t, uint32(0), pkt_.sid)
+	pkt_.Release()
+
+	pkt_, err = UnmarshalMessagePacket(pkt.appendForSubscription(nil, &Subscription{Qos: 0, SubscriptionID: 7}))
+	require.NoError(t, err)
+	require.Equal(t, byte(0), pkt_.qos)
+	require.Equal(t, false, pkt_.retain)
+	require.Equal(t, uint32(7), pkt_.sid)
+	pkt_.Release()
+
+	pkt_, err = UnmarshalMessagePacket(pkt.appendForSubscription(nil, &Subscription{Qos: 2, RetainAsPublished: true}))
+	require.NoError(t, err)
+	require.Equal(t, byte(1), pkt_.qos)
+	require.Equal(t, true, pkt_.retain)
+	require.Nil(t, pkt_.ResponseTopic())
+	require.Nil(t, pkt_.CorrelationData())
+	pkt_.Release()
+
+	// the response topic and the correlation data of the request
+	pkt.SetResponseTopic([]byte("/finance/tom/reply"))
+	pkt.SetCorrelationData([]byte{0x01, 0x02})
+	pktByte = pkt.AppendTo(nil)
+	pkt_, err = UnmarshalMessagePacket(pktByte)
+	require.NoError(t, err)
+	require.Equal(t, []byte("/finance/tom/reply"), pkt_.ResponseTopic())
+	require.Equal(t, []byte{0x01, 0x02}, pkt_.CorrelationData())
+	pkt_.Release()
+	_, err = UnmarshalMessagePacket(pktByte[:len(pktByte)-1])
+	require.Error(t, err)
+
+	// the earlier formats without the trailing groups
+	pkt.SetResponseTopic(nil)
+	pkt.SetCorrelationData(nil)
+	pktByte = pkt.AppendTo(nil)
+	for _, tail := range []int{4, 9} {
+		pkt_, err = UnmarshalMessagePacket(pktByte[:len(pktByte)-tail])
+		require.NoError(t, err)
+		require.Equal(t, pkt.topic, pkt_.topic)
+		require.Equal(t, pkt.payLoad, pkt_.payLoad)
+		require.Equal(t, tail == 4, pkt_.retain)
+		require.Nil(t, pkt_.ResponseTopic())
+		pkt_.Release()
+	}
+	_, err = UnmarshalMessagePacket(pktByte[:len(pktByte)-7])
+	require.Error(t, err)
+	_, err = UnmarshalMessagePacket(pktByte[:len(pktByte)-3])
+	require.Error(t, err)
 }
@@ -0,0 +1,43 @@
+package marina
+
+import "time"
+
+// The job runs at every interval in the background until stopped.
+type periodicJob struct {
+	exit chan struct{}
+	done chan struct{}
+}
+
+func startPeriodicJob(interval time.Duration, job func()) *periodicJob {
+	pj := &periodicJob{
+		exit: make(chan struct{}, 0),
+		done: make(chan struct{}, 0),
+	}
+
+	go func() {
+		defer close(pj.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				job()
+			case <-pj.exit:
+				return
+			}
+		}
+	}()
+
+	return pj
+}
+
+// Stop the job and wait for the running one, the nil job is ignored.
+func (pj *periodicJob) stop() {
+	if pj == nil {
+		return
+	}
+	close(pj.exit)
+	<-pj.done
+}
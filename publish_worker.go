@@ -1,10 +1,13 @@
 package marina
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
-	"github.com/TheSmallBoat/cabinet"
 	"github.com/lithdew/kademlia"
 )
 
@@ -13,19 +16,47 @@ const defaultMaxPublishWorkers = 32
 // The publish message-packets come from the producers.
 type PublishWorker struct {
 	tp    *taskPool
-	tt    *cabinet.TTree
+	tt    TopicIndex
 	kadId *kademlia.ID //the broker-peer-node kadID
 
 	pubSucNum uint32 // the success count of the publishing operation
 	pubErrNum uint32 // the error count of the publishing operation
 	fwdSucNum uint32 // the success count of the forwarding operation
 	fwdErrNum uint32 // the error count of the forwarding operation
+	rlRejNum  uint32 // the rejected count of the rate limiting
+	rlDlyNum  uint32 // the delayed count of the rate limiting
+	rlDrpNum  uint32 // the dropped count of the rate limiting
+	nlSkpNum  uint32 // the skipped count of the no-local filtering
+	azDenNum  uint32 // the denied count of the authorization
+	tqRejNum  uint32 // the rejected count of the tenant quota
+	dlDrpNum  uint32 // the dropped count of the dead letters that cannot be republished
+
+	rl *rateLimiter
+
+	mu  sync.RWMutex
+	tps []topicPriority   // the priorities of the topic prefixes
+	dlh DeadLetterHandler // the handler for the message-packets that cannot be forwarded
+	nl  bool              // the broker-wide no-local, if true the publishers never receive their own message-packets
+	az  Authorizer        // the authorizer for the publishing operation, nil means allowing all
+	dnh DenialHandler     // the handler for the denied publishing operations
+	tns *Tenants          // the tenants of the publishers, nil means no namespace
+	qs  Quotas            // the quotas of the topics, the others are applied by the twins pool
 
 	wg sync.WaitGroup
+
+	// The republishing comes from the twins at any time, so it is counted apart from the wait group.
+	rmu  sync.Mutex
+	rcd  *sync.Cond
+	rNum int // the count of the republished message-packets being forwarded
 }
 
-func NewPublishWorker(bKadId *kademlia.ID, tTree *cabinet.TTree) *PublishWorker {
-	return &PublishWorker{
+type topicPriority struct {
+	prefix   []byte
+	priority Priority
+}
+
+func NewPublishWorker(bKadId *kademlia.ID, tTree TopicIndex) *PublishWorker {
+	pw := &PublishWorker{
 		tp:        newTaskPool(defaultMaxPublishWorkers),
 		kadId:     bKadId,
 		tt:        tTree,
@@ -33,7 +64,17 @@ func NewPublishWorker(bKadId *kademlia.ID, tTree *cabinet.TTree) *PublishWorker
 		pubErrNum: 0,
 		fwdSucNum: 0,
 		fwdErrNum: 0,
+		rlRejNum:  0,
+		rlDlyNum:  0,
+		rlDrpNum:  0,
+		nlSkpNum:  0,
+		azDenNum:  0,
+		tqRejNum:  0,
+		dlDrpNum:  0,
+		rl:        newRateLimiter(),
 	}
+	pw.rcd = sync.NewCond(&pw.rmu)
+	return pw
 }
 
 func (p *PublishWorker) EntitiesNumFor(topic []byte) int {
@@ -53,50 +94,326 @@ func (p *PublishWorker) EntitiesFor(topic []byte) []interface{} {
 	return entities
 }
 
-func (p *PublishWorker) WorkFor(pkt *MessagePacket) {
+// Set the handler for the message-packets without any subscriber or to the offline twins.
+func (p *PublishWorker) SetDeadLetterHandler(handler DeadLetterHandler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dlh = handler
+}
+
+func (p *PublishWorker) deadLetter(reason DeadLetterReason, err error, kadId *kademlia.ID, data []byte) {
+	p.mu.RLock()
+	handler := p.dlh
+	p.mu.RUnlock()
+
+	if handler != nil {
+		handler(newDeadLetter(reason, err, kadId, data))
+	}
+}
+
+// Set the authorizer consulted by every publishing operation, and the handler for the denials.
+func (p *PublishWorker) SetAuthorizer(az Authorizer, handler DenialHandler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.az = az
+	p.dnh = handler
+}
+
+// Set the tenants of the publishers, which should be the same as the twins pool's.
+func (p *PublishWorker) SetTenants(tns *Tenants) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.tns = tns
+}
+
+// Set the quotas of the topics for publishing, which should be the same as the twins pool's.
+func (p *PublishWorker) SetQuotas(qs Quotas) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.qs = qs
+}
+
+// Return the tenant of the publisher, nil if the tenants are not used.
+func (p *PublishWorker) tenantOf(pkt *MessagePacket) *tenant {
+	p.mu.RLock()
+	tns := p.tns
+	p.mu.RUnlock()
+
+	var pubK kademlia.PublicKey
+	if pkt.pubKadId != nil {
+		pubK = pkt.pubKadId.Pub
+	}
+	return tns.tenantOf(pubK)
+}
+
+// Set the broker-wide no-local, the publishers never receive their own message-packets if true,
+// otherwise only the subscriptions with the no-local option skip them.
+func (p *PublishWorker) SetNoLocal(noLocal bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.nl = noLocal
+}
+
+func (p *PublishWorker) noLocal() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.nl
+}
+
+// Forward the message-packet produced by the broker itself in the namespace of the tenant, without blocking or rate limiting.
+// The message-packet is dropped and counted while the low lane is full.
+func (p *PublishWorker) republish(pkt *MessagePacket, tn *tenant) {
+	p.rmu.Lock()
+	p.rNum++
+	p.rmu.Unlock()
+
+	if !p.tp.trySubmitTask(func() {
+		defer p.republished()
+		forwardMessagePacket(p, pkt, tn, PriorityLow)
+	}) {
+		p.republished()
+		atomic.AddUint32(&p.dlDrpNum, uint32(1))
+		pkt.Release()
+	}
+}
+
+func (p *PublishWorker) republished() {
+	p.rmu.Lock()
+	defer p.rmu.Unlock()
+
+	p.rNum--
+	if p.rNum == 0 {
+		p.rcd.Broadcast()
+	}
+}
+
+// Set the priority for all the topics that start with the prefix, an existing prefix would be overwritten.
+func (p *PublishWorker) SetTopicPriority(prefix []byte, priority Priority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.tps {
+		if bytes.Equal(p.tps[i].prefix, prefix) {
+			p.tps[i].priority = priority
+			return
+		}
+	}
+	p.tps = append(p.tps, topicPriority{prefix: append([]byte(nil), prefix...), priority: priority})
+}
+
+// The higher one of the packet priority and the matched topic-prefix priority.
+func (p *PublishWorker) priorityFor(pkt *MessagePacket) Priority {
+	pkt.mu.Lock()
+	priority, topic := pkt.priority, pkt.topic
+	pkt.mu.Unlock()
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for i := range p.tps {
+		if p.tps[i].priority > priority && bytes.HasPrefix(topic, p.tps[i].prefix) {
+			priority = p.tps[i].priority
+		}
+	}
+	return priority
+}
+
+// Add a token-bucket limit for the publishing operation, all of the matched limits would be applied.
+func (p *PublishWorker) AddRateLimit(limit RateLimit) {
+	p.rl.add(limit)
+}
+
+// Return the *TopicError while the topic is invalid for publishing, the *QuotaError while the topic is too long
+// or too deep, the ErrNotAuthorized while denied,
+// the ErrTenantQuotaExceeded while the tenant publishes too fast,
+// and the ErrRateLimited while the packet has been rejected by the rate limiting.
+// The broker KadId of the packet is replaced by the broker's own one, the peer-nodes cannot claim the origin broker.
+func (p *PublishWorker) WorkFor(pkt *MessagePacket) error {
+	return p.workFor(pkt, false)
+}
+
+// Publish the message-packet forwarded by the trusted bridge, which keeps the KadId of the origin broker
+// for the loop prevention. Return the same errors as the WorkFor.
+func (p *PublishWorker) WorkForBridged(pkt *MessagePacket) error {
+	return p.workFor(pkt, true)
+}
+
+func (p *PublishWorker) workFor(pkt *MessagePacket, bridged bool) error {
 	if pkt.qos == byte(1) {
 		// Todo:process response
 	}
 
+	p.mu.RLock()
+	az, dnh, qs := p.az, p.dnh, p.qs
+	p.mu.RUnlock()
+
+	if err := ValidateTopicName(pkt.topic); err != nil {
+		atomic.AddUint32(&p.pubErrNum, uint32(1))
+		return err
+	}
+	if err := qs.checkTopic(pkt.topic); err != nil {
+		atomic.AddUint32(&p.pubErrNum, uint32(1))
+		return err
+	}
+
+	var pubK kademlia.PublicKey
+	if pkt.pubKadId != nil {
+		pubK = pkt.pubKadId.Pub
+	}
+
+	if !authorize(az, dnh, &p.azDenNum, pubK, AccessPublish, pkt.topic) {
+		return ErrNotAuthorized
+	}
+	tn := p.tenantOf(pkt)
+	if err := tn.allowPublish(); err != nil {
+		atomic.AddUint32(&p.tqRejNum, uint32(1))
+		return err
+	}
+	action, delay, limited := p.rl.check(pubK, pkt.topic)
+	if limited {
+		switch action {
+		case RateLimitReject:
+			atomic.AddUint32(&p.rlRejNum, uint32(1))
+			return ErrRateLimited
+		case RateLimitDrop:
+			atomic.AddUint32(&p.rlDrpNum, uint32(1))
+			return nil
+		default:
+			atomic.AddUint32(&p.rlDlyNum, uint32(1))
+			time.Sleep(delay)
+		}
+	}
+
+	if !bridged {
+		pkt.SetBrokerKadId(p.kadId)
+	}
+	priority := p.priorityFor(pkt)
+
 	p.wg.Add(1)
-	p.tp.submitTask(func() { forwardMessagePacket(p, pkt) })
+	p.tp.submitPriorityTask(func() {
+		defer p.wg.Done()
+		forwardMessagePacket(p, pkt, tn, priority)
+	}, priority)
+	return nil
 }
 
-// To find the matched topic, and put the messagePacket to the twin
-func forwardMessagePacket(pubW *PublishWorker, pkt *MessagePacket) {
-	defer pubW.wg.Done()
+// To find the matched topic in the namespace of the tenant, and put the messagePacket to the twin
+func forwardMessagePacket(pubW *PublishWorker, pkt *MessagePacket, tn *tenant, priority Priority) {
+	pkt.setOriginBrokerKadId(pubW.kadId)
 
-	pkt.SetBrokerKadId(pubW.kadId)
+	// The topic in the namespace of the publisher's tenant, the packet keeps the original topic.
+	topic := tn.topic(pkt.topic)
+
+	// The typed matcher, e.g. the match cache, serves the subscribers without the type switch.
+	if tm, ok := pubW.tt.(typedMatcher); ok {
+		me, err := tm.match(topic)
+		if err != nil || me.length() == 0 {
+			noSubscriber(pubW, pkt)
+			return
+		}
+		for _, tw := range me.twins {
+			forwardToTwin(pubW, pkt, tw, priority)
+		}
+		for _, sg := range me.groups {
+			forwardToGroup(pubW, pkt, sg, priority)
+		}
+		atomic.AddUint32(&pubW.pubSucNum, uint32(1))
+		return
+	}
 
-	entities := pubW.EntitiesFor(pkt.topic)
+	entities := pubW.EntitiesFor(topic)
 	if entities == nil {
-		atomic.AddUint32(&pubW.pubErrNum, uint32(1))
+		noSubscriber(pubW, pkt)
 		return
 	}
 
-	dst := make([]byte, 0)
 	for _, v := range entities {
-		tw := v.(*twin)
-		if tw != nil {
-			pkt.SetSubscriberKadId((*tw.prd).KadID())
-
-			dst = dst[0:0]
-			err := tw.pushMessagePacketToChannel(pkt.AppendTo(dst))
-			if err != nil {
-				atomic.AddUint32(&pubW.fwdErrNum, uint32(1))
-			} else {
-				atomic.AddUint32(&pubW.fwdSucNum, uint32(1))
-			}
+		switch e := v.(type) {
+		case *twin:
+			forwardToTwin(pubW, pkt, e, priority)
+		case *shareGroup:
+			forwardToGroup(pubW, pkt, e, priority)
 		}
 	}
 
 	atomic.AddUint32(&pubW.pubSucNum, uint32(1))
 }
 
+func noSubscriber(pubW *PublishWorker, pkt *MessagePacket) {
+	atomic.AddUint32(&pubW.pubErrNum, uint32(1))
+	pubW.deadLetter(DeadLetterNoSubscriber, fmt.Errorf("no subscriber for the topic '%s'", pkt.topic), nil, pkt.AppendTo(nil))
+}
+
+func forwardToTwin(pubW *PublishWorker, pkt *MessagePacket, tw *twin, priority Priority) {
+	if tw == nil {
+		return
+	}
+	prd := tw.provider()
+	if prd == nil {
+		// The twin has been released after matched.
+		atomic.AddUint32(&pubW.fwdErrNum, uint32(1))
+		pubW.deadLetter(DeadLetterTwinOffline, fmt.Errorf("the twin has been released"), nil, pkt.AppendTo(nil))
+		return
+	}
+	kadId := (*prd).KadID()
+	pkt.SetSubscriberKadId(kadId)
+
+	// Every twin owns the fresh data, built by the options of its subscription.
+	sub, ok := tw.subscriptionFor(pkt.topic)
+	if (pubW.noLocal() || (ok && sub.NoLocal)) && pkt.pubKadId != nil && pkt.pubKadId.Pub == kadId.Pub {
+		atomic.AddUint32(&pubW.nlSkpNum, uint32(1))
+		return
+	}
+	var data []byte
+	if ok {
+		data = pkt.appendForSubscription(nil, &sub)
+	} else {
+		data = pkt.AppendTo(nil)
+	}
+	err := tw.pushMessagePacketWithPriority(data, priority)
+	if err != nil {
+		atomic.AddUint32(&pubW.fwdErrNum, uint32(1))
+		reason := DeadLetterTwinOffline
+		if errors.Is(err, ErrQuotaExceeded) {
+			reason = DeadLetterQuotaExceeded
+		} else if errors.Is(err, ErrTwinOverflow) {
+			reason = DeadLetterOverflow
+		}
+		pubW.deadLetter(reason, err, kadId, data)
+	} else {
+		atomic.AddUint32(&pubW.fwdSucNum, uint32(1))
+	}
+}
+
+// Each message-packet goes to exactly one online member of the shared subscription group.
+func forwardToGroup(pubW *PublishWorker, pkt *MessagePacket, sg *shareGroup, priority Priority) {
+	tw := sg.pick(pkt)
+	if tw == nil {
+		atomic.AddUint32(&pubW.fwdErrNum, uint32(1))
+		pubW.deadLetter(DeadLetterTwinOffline, fmt.Errorf("no online member in the shared subscription group '%s'", sg.name), nil, pkt.AppendTo(nil))
+		return
+	}
+	forwardToTwin(pubW, pkt, tw, priority)
+}
+
 func (p *PublishWorker) Close() {
 	p.tp.close()
 }
 
+// Wait for the published message-packets, and then the republished ones.
 func (p *PublishWorker) Wait() {
 	p.wg.Wait()
+
+	p.rmu.Lock()
+	defer p.rmu.Unlock()
+
+	for p.rNum > 0 {
+		p.rcd.Wait()
+	}
 }
@@ -1,6 +1,7 @@
 package marina
 
 import (
+	"errors"
 	"testing"
 	"time"
 
@@ -272,3 +273,209 @@ func TestPublishWorkerForMultipleSubscribe(t *testing.T) {
 	require.Equal(t, uint64(len(pkt.AppendTo(dst))), twp.acquire(&prdC).transSucSize+twp.acquire(&prdC).transErrSize)
 
 }
+
+func TestPublishWorkerTopicPriority(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		err := tt.Close()
+		require.NoError(t, err)
+	}()
+
+	pKid, err1 := generateKadId()
+	require.NoError(t, err1)
+	bKid, err2 := generateKadId()
+	require.NoError(t, err2)
+
+	pw := NewPublishWorker(bKid, tt)
+	defer pw.Close()
+
+	pkt := NewMessagePacket(pKid, uint32(1), byte(0), []byte("/alarm/fire"), []byte("xyz"))
+	defer pkt.Release()
+	require.Equal(t, PriorityLow, pw.priorityFor(pkt))
+
+	pw.SetTopicPriority([]byte("/alarm/"), PriorityHigh)
+	require.Equal(t, PriorityHigh, pw.priorityFor(pkt))
+
+	pw.SetTopicPriority([]byte("/alarm/"), PriorityLow)
+	require.Equal(t, 1, len(pw.tps))
+	require.Equal(t, PriorityLow, pw.priorityFor(pkt))
+
+	pkt.SetPriority(PriorityHigh)
+	require.Equal(t, PriorityHigh, pw.priorityFor(pkt))
+
+	pkt2 := NewMessagePacket(pKid, uint32(2), byte(0), []byte("/telemetry/cpu"), []byte("xyz"))
+	pw.SetTopicPriority([]byte("/control/"), PriorityHigh)
+	require.Equal(t, PriorityLow, pw.priorityFor(pkt2))
+	pkt2.Release()
+	require.Equal(t, PriorityLow, pkt2.priority)
+
+	pkt3 := NewMessagePacket(pKid, uint32(3), byte(0), []byte("/alarm/+"), []byte("xyz"))
+	defer pkt3.Release()
+	require.True(t, errors.Is(pw.WorkFor(pkt3), ErrPublishTopicWildcard))
+	require.Equal(t, uint32(1), pw.pubErrNum)
+}
+
+func TestPublishWorkerRateLimit(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		err := tt.Close()
+		require.NoError(t, err)
+	}()
+
+	pKid, err1 := generateKadId()
+	require.NoError(t, err1)
+	bKid, err2 := generateKadId()
+	require.NoError(t, err2)
+
+	pw := NewPublishWorker(bKid, tt)
+	defer pw.Close()
+
+	pw.AddRateLimit(RateLimit{TopicPrefix: []byte("/finance/"), PerPublisher: true, Rate: 0.001, Burst: 1, Action: RateLimitReject})
+	pw.AddRateLimit(RateLimit{TopicPrefix: []byte("/sport/"), Rate: 0.001, Burst: 1, Action: RateLimitDrop})
+	pw.AddRateLimit(RateLimit{TopicPrefix: []byte("/weather/"), Rate: 500, Burst: 1, Action: RateLimitDelay})
+
+	require.NoError(t, pw.WorkFor(NewMessagePacket(pKid, uint32(1), byte(0), []byte("/finance/tom"), []byte("xyz"))))
+	require.Equal(t, ErrRateLimited, pw.WorkFor(NewMessagePacket(pKid, uint32(2), byte(0), []byte("/finance/tom"), []byte("xyz"))))
+
+	require.NoError(t, pw.WorkFor(NewMessagePacket(pKid, uint32(3), byte(0), []byte("/sport/tom"), []byte("xyz"))))
+	require.NoError(t, pw.WorkFor(NewMessagePacket(pKid, uint32(4), byte(0), []byte("/sport/tom"), []byte("xyz"))))
+
+	require.NoError(t, pw.WorkFor(NewMessagePacket(pKid, uint32(5), byte(0), []byte("/weather/today"), []byte("xyz"))))
+	require.NoError(t, pw.WorkFor(NewMessagePacket(pKid, uint32(6), byte(0), []byte("/weather/today"), []byte("xyz"))))
+	pw.Wait()
+
+	require.Equal(t, uint32(1), pw.rlRejNum)
+	require.Equal(t, uint32(1), pw.rlDrpNum)
+	require.Equal(t, uint32(1), pw.rlDlyNum)
+	// no subscriber for all of the forwarded packets
+	require.Equal(t, uint32(4), pw.pubErrNum)
+}
+
+func TestPublishWorkerSubscriptionOptions(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		err := tt.Close()
+		require.NoError(t, err)
+	}()
+
+	twp := NewTwinsPool()
+	defer twp.Close()
+
+	sw := NewSubscribeWorker(twp, tt)
+	defer sw.Close()
+
+	bKid, err1 := generateKadId()
+	require.NoError(t, err1)
+	sKid1, err2 := generateKadId()
+	require.NoError(t, err2)
+	sKid2, err3 := generateKadId()
+	require.NoError(t, err3)
+
+	pw := NewPublishWorker(bKid, tt)
+	defer pw.Close()
+
+	gate := make(chan struct{})
+	close(gate)
+	gp1 := &gatedProvider{kadId: sKid1, gate: gate}
+	gp2 := &gatedProvider{kadId: sKid2, gate: gate}
+	var prd1 TwinServiceProvider = gp1
+	var prd2 TwinServiceProvider = gp2
+
+	result := <-sw.PeerNodeSubscribeWithOptions(&prd1, Subscription{Topic: []byte("/chat/#"), Qos: 0, SubscriptionID: 7})
+	require.NoError(t, result.Err)
+	result = <-sw.PeerNodeSubscribeWithOptions(&prd2, Subscription{Topic: []byte("/chat/+"), Qos: 2, NoLocal: true, RetainAsPublished: true})
+	require.NoError(t, result.Err)
+
+	// published by the peer-node 2, which is not echoed to itself
+	pkt := NewMessagePacket(sKid2, uint32(1), byte(1), []byte("/chat/room"), []byte("hi"))
+	pkt.SetRetain(true)
+	require.NoError(t, pw.WorkFor(pkt))
+	pw.Wait()
+	pkt.Release()
+
+	require.Eventually(t, func() bool { return len(gp1.received()) == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, 0, len(gp2.received()))
+	require.Equal(t, uint32(1), pw.nlSkpNum)
+
+	pkt1, err := UnmarshalMessagePacket(gp1.received()[0])
+	require.NoError(t, err)
+	defer pkt1.Release()
+	require.Equal(t, byte(0), pkt1.qos)
+	require.Equal(t, false, pkt1.retain)
+	require.Equal(t, uint32(7), pkt1.sid)
+
+	// published by the peer-node 1
+	pkt = NewMessagePacket(sKid1, uint32(2), byte(1), []byte("/chat/room"), []byte("hello"))
+	pkt.SetRetain(true)
+	require.NoError(t, pw.WorkFor(pkt))
+	pw.Wait()
+	pkt.Release()
+
+	require.Eventually(t, func() bool { return len(gp2.received()) == 1 }, time.Second, time.Millisecond)
+	pkt2, err := UnmarshalMessagePacket(gp2.received()[0])
+	require.NoError(t, err)
+	defer pkt2.Release()
+	require.Equal(t, byte(1), pkt2.qos)
+	require.Equal(t, true, pkt2.retain)
+	require.Equal(t, uint32(0), pkt2.sid)
+	sw.Wait()
+}
+
+func TestPublishWorkerNoLocal(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		err := tt.Close()
+		require.NoError(t, err)
+	}()
+
+	twp := NewTwinsPool()
+	defer twp.Close()
+
+	sw := NewSubscribeWorker(twp, tt)
+	defer sw.Close()
+
+	bKid, err1 := generateKadId()
+	require.NoError(t, err1)
+	sKid1, err2 := generateKadId()
+	require.NoError(t, err2)
+	sKid2, err3 := generateKadId()
+	require.NoError(t, err3)
+
+	pw := NewPublishWorker(bKid, tt)
+	defer pw.Close()
+
+	gate := make(chan struct{})
+	close(gate)
+	gp1 := &gatedProvider{kadId: sKid1, gate: gate}
+	gp2 := &gatedProvider{kadId: sKid2, gate: gate}
+	var prd1 TwinServiceProvider = gp1
+	var prd2 TwinServiceProvider = gp2
+
+	require.NoError(t, (<-sw.PeerNodeSubscribe(&prd1, byte(0), []byte("/chat/room"))).Err)
+	require.NoError(t, (<-sw.PeerNodeSubscribe(&prd2, byte(0), []byte("/chat/room"))).Err)
+
+	// echoed by default
+	require.NoError(t, pw.WorkFor(NewMessagePacket(sKid1, uint32(1), byte(0), []byte("/chat/room"), []byte("hi"))))
+	pw.Wait()
+	require.Eventually(t, func() bool {
+		return len(gp1.received()) == 1 && len(gp2.received()) == 1
+	}, time.Second, time.Millisecond)
+
+	// skipped by the broker-wide no-local
+	pw.SetNoLocal(true)
+	require.NoError(t, pw.WorkFor(NewMessagePacket(sKid1, uint32(2), byte(0), []byte("/chat/room"), []byte("hello"))))
+	pw.Wait()
+	require.Eventually(t, func() bool { return len(gp2.received()) == 2 }, time.Second, time.Millisecond)
+	require.Equal(t, 1, len(gp1.received()))
+	require.Equal(t, uint32(1), pw.nlSkpNum)
+	require.Equal(t, uint32(3), pw.fwdSucNum)
+	sw.Wait()
+}
@@ -0,0 +1,101 @@
+package marina
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+var ErrQuotaExceeded = errors.New("the quota is exceeded")
+
+// The quotas of the broker, the zero value means unlimited.
+type Quotas struct {
+	MaxTwins                int   // The max number of the twins in the pool.
+	MaxProviders            int   // The max number of the service providers paired with the twins.
+	MaxSubscriptionsPerPeer int   // The max number of the subscriptions of one peer-node.
+	MaxTopicLength          int   // The max bytes of the topic or the topic filter.
+	MaxTopicDepth           int   // The max levels of the topic or the topic filter, the shared prefix excluded.
+	MaxQueuedBytesPerTwin   int64 // The max bytes queued by one twin, either in the channels or in the session.
+	MaxQueuedBytes          int64 // The max bytes queued by all the twins of the pool.
+}
+
+// The error of the exceeded quota, which matches the ErrQuotaExceeded.
+type QuotaError struct {
+	Quota string // The name of the exceeded quota.
+	Limit int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("the quota of the %s is exceeded, the limit is %d", e.Quota, e.Limit)
+}
+
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// Return the *QuotaError if the topic is too long or too deep.
+func (q Quotas) checkTopic(topic []byte) error {
+	if q.MaxTopicLength > 0 && len(topic) > q.MaxTopicLength {
+		return &QuotaError{Quota: "topic length", Limit: int64(q.MaxTopicLength)}
+	}
+	if q.MaxTopicDepth > 0 {
+		if _, filter, shared, err := parseSharedTopic(topic); err == nil && shared {
+			topic = filter
+		}
+		if bytes.Count(topic, []byte{topicSeparator})+1 > q.MaxTopicDepth {
+			return &QuotaError{Quota: "topic depth", Limit: int64(q.MaxTopicDepth)}
+		}
+	}
+	return nil
+}
+
+// The meter of the bytes queued by all the twins of the pool, the nil meter is unlimited.
+type byteMeter struct {
+	size int64
+	max  int64 // The max bytes, zero means unlimited.
+}
+
+func newByteMeter() *byteMeter {
+	return &byteMeter{}
+}
+
+func (bm *byteMeter) setMax(max int64) {
+	atomic.StoreInt64(&bm.max, max)
+}
+
+// Return false if the bytes would exceed the max.
+func (bm *byteMeter) reserve(n int64) bool {
+	if bm == nil {
+		return true
+	}
+	for {
+		size, max := atomic.LoadInt64(&bm.size), atomic.LoadInt64(&bm.max)
+		if max > 0 && size+n > max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&bm.size, size, size+n) {
+			return true
+		}
+	}
+}
+
+func (bm *byteMeter) release(n int64) {
+	if bm != nil && n != 0 {
+		atomic.AddInt64(&bm.size, -n)
+	}
+}
+
+func (bm *byteMeter) length() int64 {
+	if bm == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&bm.size)
+}
+
+func (bm *byteMeter) limit() int64 {
+	if bm == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&bm.max)
+}
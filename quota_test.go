@@ -0,0 +1,214 @@
+package marina
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TheSmallBoat/cabinet"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestQuotasTopic(t *testing.T) {
+	qs := Quotas{MaxTopicLength: 16, MaxTopicDepth: 3}
+	require.NoError(t, qs.checkTopic([]byte("/finance/tom")))
+	require.NoError(t, qs.checkTopic([]byte("$share/g/a/b/c")))
+
+	err := qs.checkTopic([]byte("/finance/tom/cash"))
+	require.True(t, errors.Is(err, ErrQuotaExceeded))
+	require.Equal(t, "the quota of the topic length is exceeded, the limit is 16", err.Error())
+	err = qs.checkTopic([]byte("a/b/c/d"))
+	require.True(t, errors.Is(err, ErrQuotaExceeded))
+	require.Equal(t, &QuotaError{Quota: "topic depth", Limit: 3}, err)
+	require.Equal(t, AckQuotaExceeded, ackCodeOf(0, err))
+
+	require.NoError(t, Quotas{}.checkTopic(make([]byte, 1024)))
+}
+
+func TestTwinsPoolQuotas(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		err := tt.Close()
+		require.NoError(t, err)
+	}()
+
+	twp := NewTwinsPool()
+	defer twp.Close()
+	twp.SetQuotas(Quotas{MaxTwins: 2, MaxProviders: 1, MaxSubscriptionsPerPeer: 2, MaxTopicDepth: 3})
+
+	sw := NewSubscribeWorker(twp, tt)
+	defer sw.Close()
+
+	prds := make([]TwinServiceProvider, 3)
+	for i := range prds {
+		kid, err := generateKadId()
+		require.NoError(t, err)
+		prds[i] = &provider{kadId: kid}
+	}
+
+	pn, err := twp.appendProviders(&prds[0], &prds[1])
+	require.Equal(t, 1, pn)
+	require.True(t, errors.Is(err, ErrQuotaExceeded))
+	require.Equal(t, "the quota of the providers is exceeded, the limit is 1", err.Error())
+
+	require.NoError(t, (<-sw.PeerNodeSubscribe(&prds[0], byte(0), []byte("/finance/tom"))).Err)
+	result := <-sw.PeerNodeSubscribe(&prds[0], byte(0), []byte("/finance/tom/cash"))
+	require.Equal(t, AckQuotaExceeded, result.Code)
+	require.NoError(t, (<-sw.PeerNodeSubscribe(&prds[0], byte(1), []byte("/finance/jack"))).Err)
+	// the subscribing again to the same topic is not counted
+	require.NoError(t, (<-sw.PeerNodeSubscribe(&prds[0], byte(0), []byte("/finance/jack"))).Err)
+	result = <-sw.PeerNodeSubscribe(&prds[0], byte(0), []byte("/finance/bob"))
+	require.Equal(t, AckQuotaExceeded, result.Code)
+	require.Equal(t, &QuotaError{Quota: "subscriptions per peer", Limit: 2}, result.Err)
+
+	require.NoError(t, (<-sw.PeerNodeSubscribe(&prds[1], byte(0), []byte("/finance/tom"))).Err)
+	result = <-sw.PeerNodeSubscribe(&prds[2], byte(0), []byte("/finance/tom"))
+	require.Equal(t, AckQuotaExceeded, result.Code)
+	require.Equal(t, &QuotaError{Quota: "twins", Limit: 2}, result.Err)
+	require.Nil(t, twp.acquire(&prds[2]))
+	require.Equal(t, 2, len(twp.twins()))
+	sw.Wait()
+}
+
+func TestTwinsPoolTwinsQuotaConcurrent(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	twp := NewTwinsPool()
+	defer twp.Close()
+	twp.SetQuotas(Quotas{MaxTwins: 3})
+
+	tns := NewTenants()
+	require.NoError(t, tns.Add("acme", TenantQuota{MaxTwins: 1}))
+	twp.SetTenants(tns)
+
+	// the twins acquired concurrently never overrun the quota, and the refused providers are not appended
+	num := 20
+	errs := make([]error, num)
+	var wg sync.WaitGroup
+	for i := 0; i < num; i++ {
+		kid, err := generateKadId()
+		require.NoError(t, err)
+		var prd TwinServiceProvider = &provider{kadId: kid}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = twp.appendProviders(&prd)
+		}(i)
+	}
+	wg.Wait()
+
+	refused := 0
+	for _, err := range errs {
+		if err != nil {
+			require.Equal(t, &QuotaError{Quota: "twins", Limit: 3}, err)
+			refused++
+		}
+	}
+	require.Equal(t, num-3, refused)
+	tNum, pNum := twp.length()
+	require.Equal(t, 3, tNum)
+	require.Equal(t, 3, pNum)
+
+	// the tenant quota of the twins
+	twp.SetQuotas(Quotas{})
+	for i := 0; i < 2; i++ {
+		kid, err := generateKadId()
+		require.NoError(t, err)
+		require.NoError(t, tns.Assign(kid.Pub, "acme"))
+		var prd TwinServiceProvider = &provider{kadId: kid}
+		pn, err := twp.appendProviders(&prd)
+		if i == 0 {
+			require.Equal(t, 1, pn)
+			require.NoError(t, err)
+		} else {
+			require.Equal(t, 0, pn)
+			require.True(t, errors.Is(err, ErrTenantQuotaExceeded))
+		}
+	}
+	tNum, pNum = twp.length()
+	require.Equal(t, 4, tNum)
+	require.Equal(t, 4, pNum)
+}
+
+func TestTwinsPoolQueuedBytes(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	twp := NewTwinsPool()
+	defer twp.Close()
+	twp.SetQuotas(Quotas{MaxQueuedBytesPerTwin: 10, MaxQueuedBytes: 12})
+
+	gate := make(chan struct{})
+	gps := make([]*gatedProvider, 2)
+	tws := make([]*twin, 2)
+	for i := range gps {
+		kid, err := generateKadId()
+		require.NoError(t, err)
+		gps[i] = &gatedProvider{kadId: kid, gate: gate}
+		var prd TwinServiceProvider = gps[i]
+		tws[i] = twp.acquire(&prd)
+	}
+
+	// the first data is blocked in the provider, and not queued any more
+	require.NoError(t, tws[0].pushMessagePacketToChannel([]byte("abcd")))
+	require.Eventually(t, func() bool { return len(gps[0].received()) == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, int64(0), twp.queuedBytes())
+
+	require.NoError(t, tws[0].pushMessagePacketToChannel([]byte("abcd")))
+	require.NoError(t, tws[0].pushMessagePacketToChannel([]byte("abcd")))
+	require.Equal(t, int64(8), tws[0].queuedBytes())
+	err := tws[0].pushMessagePacketToChannel([]byte("abcd"))
+	require.Equal(t, &QuotaError{Quota: "queued bytes per twin", Limit: 10}, err)
+	require.Equal(t, uint32(1), tws[0].pushErrNum)
+
+	require.NoError(t, tws[1].pushMessagePacketToChannel([]byte("abcd")))
+	require.Eventually(t, func() bool { return len(gps[1].received()) == 1 }, time.Second, time.Millisecond)
+	require.NoError(t, tws[1].pushMessagePacketToChannel([]byte("abcd")))
+	require.Equal(t, int64(12), twp.queuedBytes())
+	err = tws[1].pushMessagePacketToChannel([]byte("ab"))
+	require.Equal(t, &QuotaError{Quota: "queued bytes", Limit: 12}, err)
+	require.True(t, errors.Is(err, ErrQuotaExceeded))
+
+	// the delivered data releases the quotas
+	close(gate)
+	require.Eventually(t, func() bool { return twp.queuedBytes() == 0 }, time.Second, time.Millisecond)
+	require.NoError(t, tws[1].pushMessagePacketToChannel([]byte("ab")))
+	require.Eventually(t, func() bool { return len(gps[1].received()) == 3 }, time.Second, time.Millisecond)
+
+	// the data stashed in the persistent session is still queued, and released by the clean session
+	pubK := gps[0].kadId.Pub
+	twp.SetCleanSession(pubK, false)
+	tws[0].turnToOffline()
+	require.NoError(t, tws[0].pushMessagePacketToChannel([]byte("abcd")))
+	require.Equal(t, int64(4), tws[0].queuedBytes())
+	require.Equal(t, int64(4), twp.queuedBytes())
+	twp.SetCleanSession(pubK, true)
+	require.Equal(t, int64(0), twp.queuedBytes())
+}
+
+func TestPublishWorkerQuotas(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		err := tt.Close()
+		require.NoError(t, err)
+	}()
+
+	bKid, err := generateKadId()
+	require.NoError(t, err)
+	pKid, err := generateKadId()
+	require.NoError(t, err)
+
+	pw := NewPublishWorker(bKid, tt)
+	defer pw.Close()
+	pw.SetQuotas(Quotas{MaxTopicLength: 8})
+
+	err = pw.WorkFor(NewMessagePacket(pKid, uint32(1), byte(0), []byte("/finance/tom"), []byte("xyz")))
+	require.Equal(t, &QuotaError{Quota: "topic length", Limit: 8}, err)
+	require.Equal(t, uint32(1), pw.pubErrNum)
+	pw.Wait()
+}
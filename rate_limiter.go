@@ -0,0 +1,185 @@
+package marina
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lithdew/kademlia"
+)
+
+const defaultMaxRateLimitBuckets = 65536 // The max buckets of the per-publisher rule before purging the idle ones.
+
+var ErrRateLimited = errors.New("marina: the rate limit has been exceeded")
+
+// The action while the rate limit has been hit.
+type RateLimitAction byte
+
+const (
+	RateLimitReject RateLimitAction = iota // Return the ErrRateLimited to the caller.
+	RateLimitDelay                         // Block the caller until the token is available.
+	RateLimitDrop                          // Discard the message-packet silently, only be counted.
+)
+
+type RateLimit struct {
+	TopicPrefix  []byte          // Only limit the topics with this prefix, the empty prefix means all of the topics.
+	PerPublisher bool            // One bucket for each publisher public key, otherwise one bucket shared by all of the publishers.
+	Rate         float64         // The number of the message-packets per second.
+	Burst        int             // The max number of the message-packets in a burst.
+	Action       RateLimitAction // The action while the limit has been hit.
+}
+
+// The token-bucket, refilled by the rate per second, and up to the burst.
+type tokenBucket struct {
+	mu sync.Mutex
+
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		mu:     sync.Mutex{},
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+}
+
+// Take the tokens if they are available.
+func (tb *tokenBucket) allow(n float64) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(time.Now())
+	if tb.tokens < n {
+		return false
+	}
+	tb.tokens -= n
+	return true
+}
+
+// Return true if the tokens are available, without taking them.
+func (tb *tokenBucket) available(n float64) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(time.Now())
+	return tb.tokens >= n
+}
+
+// Take the tokens anyway, and return the waiting duration until they would have been available.
+func (tb *tokenBucket) reserve(n float64) time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(time.Now())
+	tb.tokens -= n
+	if tb.tokens >= 0 || tb.rate <= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+func (tb *tokenBucket) full() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(time.Now())
+	return tb.tokens >= tb.burst
+}
+
+type rateLimitRule struct {
+	limit  RateLimit
+	shared *tokenBucket
+	mpb    map[kademlia.PublicKey]*tokenBucket
+}
+
+func (r *rateLimitRule) bucketFor(pubK kademlia.PublicKey) *tokenBucket {
+	if !r.limit.PerPublisher {
+		return r.shared
+	}
+
+	tb, exist := r.mpb[pubK]
+	if !exist {
+		if len(r.mpb) >= defaultMaxRateLimitBuckets {
+			// Purging the buckets of the idle publishers.
+			for k, b := range r.mpb {
+				if b.full() {
+					delete(r.mpb, k)
+				}
+			}
+		}
+		tb = newTokenBucket(r.limit.Rate, r.limit.Burst)
+		r.mpb[pubK] = tb
+	}
+	return tb
+}
+
+type rateLimiter struct {
+	mu    sync.Mutex
+	rules []*rateLimitRule
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{mu: sync.Mutex{}}
+}
+
+func (rl *rateLimiter) add(limit RateLimit) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	limit.TopicPrefix = append([]byte(nil), limit.TopicPrefix...)
+	rl.rules = append(rl.rules, &rateLimitRule{
+		limit:  limit,
+		shared: newTokenBucket(limit.Rate, limit.Burst),
+		mpb:    make(map[kademlia.PublicKey]*tokenBucket),
+	})
+}
+
+// Return the action if any rule has been hit, otherwise the duration to be delayed.
+// The tokens are taken only if none of the matched rules rejects or drops the packet.
+func (rl *rateLimiter) check(pubK kademlia.PublicKey, topic []byte) (RateLimitAction, time.Duration, bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	matched := make([]*rateLimitRule, 0, len(rl.rules))
+	buckets := make([]*tokenBucket, 0, len(rl.rules))
+	for _, r := range rl.rules {
+		if !bytes.HasPrefix(topic, r.limit.TopicPrefix) {
+			continue
+		}
+
+		tb := r.bucketFor(pubK)
+		if r.limit.Action != RateLimitDelay && !tb.available(1) {
+			return r.limit.Action, 0, true
+		}
+		matched = append(matched, r)
+		buckets = append(buckets, tb)
+	}
+
+	var delay time.Duration
+	for i, r := range matched {
+		if r.limit.Action != RateLimitDelay {
+			buckets[i].allow(1)
+		} else if d := buckets[i].reserve(1); d > delay {
+			delay = d
+		}
+	}
+	return RateLimitDelay, delay, delay > 0
+}
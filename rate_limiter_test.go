@@ -0,0 +1,98 @@
+package marina
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestTokenBucket(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tb := newTokenBucket(1000, 2)
+	require.Equal(t, true, tb.full())
+	require.Equal(t, true, tb.allow(1))
+	require.Equal(t, true, tb.allow(1))
+	require.Equal(t, false, tb.allow(1))
+	require.Equal(t, false, tb.full())
+
+	time.Sleep(5 * time.Millisecond)
+	require.Equal(t, true, tb.full())
+	require.Equal(t, true, tb.allow(1))
+
+	tb = newTokenBucket(100, 0)
+	require.Equal(t, time.Duration(0), tb.reserve(1))
+	d := tb.reserve(1)
+	require.Equal(t, true, d > 5*time.Millisecond && d <= 10*time.Millisecond)
+}
+
+func TestRateLimiter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	kid1, err1 := generateKadId()
+	require.NoError(t, err1)
+	kid2, err2 := generateKadId()
+	require.NoError(t, err2)
+
+	rl := newRateLimiter()
+	_, _, limited := rl.check(kid1.Pub, []byte("/finance/tom"))
+	require.Equal(t, false, limited)
+
+	rl.add(RateLimit{TopicPrefix: []byte("/finance/"), PerPublisher: true, Rate: 0.001, Burst: 1, Action: RateLimitReject})
+	rl.add(RateLimit{TopicPrefix: []byte("/sport/"), Rate: 0.001, Burst: 1, Action: RateLimitDrop})
+
+	// per publisher
+	_, _, limited = rl.check(kid1.Pub, []byte("/finance/tom"))
+	require.Equal(t, false, limited)
+	action, _, limited := rl.check(kid1.Pub, []byte("/finance/jack"))
+	require.Equal(t, true, limited)
+	require.Equal(t, RateLimitReject, action)
+	_, _, limited = rl.check(kid2.Pub, []byte("/finance/tom"))
+	require.Equal(t, false, limited)
+
+	// per topic prefix
+	_, _, limited = rl.check(kid1.Pub, []byte("/sport/tom"))
+	require.Equal(t, false, limited)
+	action, _, limited = rl.check(kid2.Pub, []byte("/sport/jack"))
+	require.Equal(t, true, limited)
+	require.Equal(t, RateLimitDrop, action)
+
+	_, _, limited = rl.check(kid2.Pub, []byte("/weather/today"))
+	require.Equal(t, false, limited)
+
+	// for all
+	rl.add(RateLimit{Rate: 100, Burst: 1, Action: RateLimitDelay})
+	action, delay, limited := rl.check(kid2.Pub, []byte("/weather/today"))
+	require.Equal(t, false, limited)
+	require.Equal(t, time.Duration(0), delay)
+	action, delay, limited = rl.check(kid2.Pub, []byte("/weather/today"))
+	require.Equal(t, true, limited)
+	require.Equal(t, RateLimitDelay, action)
+	require.Equal(t, true, delay > 0)
+}
+
+func TestRateLimiterNoPartialSpending(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	kid, err := generateKadId()
+	require.NoError(t, err)
+
+	rl := newRateLimiter()
+	rl.add(RateLimit{Rate: 0.001, Burst: 1, Action: RateLimitDelay})
+	rl.add(RateLimit{TopicPrefix: []byte("/finance/"), Rate: 0.001, Burst: 1, Action: RateLimitDrop})
+	rl.add(RateLimit{TopicPrefix: []byte("/finance/"), Rate: 0.001, Burst: 0, Action: RateLimitReject})
+	rl.rules[2].shared.tokens = 0
+
+	// the rejected packet spends neither the delay token nor the drop token
+	action, _, limited := rl.check(kid.Pub, []byte("/finance/tom"))
+	require.Equal(t, true, limited)
+	require.Equal(t, RateLimitReject, action)
+	require.Equal(t, true, rl.rules[0].shared.full())
+	require.Equal(t, true, rl.rules[1].shared.full())
+
+	_, delay, limited := rl.check(kid.Pub, []byte("/sport/tom"))
+	require.Equal(t, false, limited)
+	require.Equal(t, time.Duration(0), delay)
+}
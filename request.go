@@ -0,0 +1,179 @@
+package marina
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lithdew/kademlia"
+)
+
+var (
+	ErrRequestTimeout  = errors.New("the request is timeout")
+	ErrNoResponseTopic = errors.New("no response topic in the request")
+)
+
+const replyTopicPrefix = "$reply/"
+
+// The requester publishes the requests through the publish worker, and waits for the responses on the temporary
+// subscriptions of the unique reply topics. The responders publish the responses to the response topic of the request
+// with the same correlation data, e.g. by the NewResponsePacket.
+// The requester is one peer-node with its own KadID, which should be allowed to subscribe the reply topics.
+type Requester struct {
+	kadId *kademlia.ID
+	prd   TwinServiceProvider // the provider of the requester's twin, which receives the responses
+	pw    *PublishWorker
+	sw    *SubscribeWorker
+
+	reqNum uint32 // the count of the published requests
+	rspNum uint32 // the count of the received responses
+	tmoNum uint32 // the count of the timeout requests
+
+	mu  sync.Mutex
+	mpw map[string]chan *MessagePacket // the waiting requests keyed by the correlation data
+}
+
+func NewRequester(kadId *kademlia.ID, pw *PublishWorker, sw *SubscribeWorker) *Requester {
+	r := &Requester{
+		kadId:  kadId,
+		pw:     pw,
+		sw:     sw,
+		reqNum: 0,
+		rspNum: 0,
+		tmoNum: 0,
+		mu:     sync.Mutex{},
+		mpw:    make(map[string]chan *MessagePacket),
+	}
+	r.prd = &replyProvider{r: r}
+	return r
+}
+
+// Pair the requester's twin with its provider in the twins pool, which should be called once before the requests.
+// Return the *QuotaError while the pool has no room for the provider.
+func (r *Requester) Start() error {
+	_, err := r.sw.twp.appendProviders(&r.prd)
+	return err
+}
+
+// Publish the request with the unique response topic and correlation data, and wait for the response until the timeout.
+// The temporary subscription of the response topic is removed afterwards, and the caller releases the response.
+func (r *Requester) Request(pkt *MessagePacket, timeout time.Duration) (*MessagePacket, error) {
+	cor := make([]byte, 8)
+	if _, err := rand.Read(cor); err != nil {
+		return nil, err
+	}
+	topic := r.replyTopic(cor)
+
+	ch := make(chan *MessagePacket, 1)
+	r.mu.Lock()
+	r.mpw[string(cor)] = ch
+	r.mu.Unlock()
+	defer r.cleanup(cor, topic)
+
+	if result := <-r.sw.PeerNodeSubscribe(&r.prd, pkt.qos, topic); result.Err != nil {
+		return nil, result.Err
+	}
+
+	pkt.SetResponseTopic(topic)
+	pkt.SetCorrelationData(cor)
+	if err := r.pw.WorkFor(pkt); err != nil {
+		return nil, err
+	}
+	atomic.AddUint32(&r.reqNum, uint32(1))
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case rsp := <-ch:
+		atomic.AddUint32(&r.rspNum, uint32(1))
+		return rsp, nil
+	case <-timer.C:
+		atomic.AddUint32(&r.tmoNum, uint32(1))
+		return nil, fmt.Errorf("%w: no response on the topic '%s' in %v", ErrRequestTimeout, topic, timeout)
+	}
+}
+
+// Unpair the requester's twin from its provider, after all the requests have returned.
+func (r *Requester) Close() {
+	r.sw.twp.removeProviders(&r.prd)
+}
+
+// Return the reply topic unique to the requester and the correlation data.
+func (r *Requester) replyTopic(cor []byte) []byte {
+	topic := make([]byte, 0, len(replyTopicPrefix)+2*len(r.kadId.Pub)+1+2*len(cor))
+	topic = append(topic, replyTopicPrefix...)
+	topic = append(topic, hex.EncodeToString(r.kadId.Pub[:])...)
+	topic = append(topic, topicSeparator)
+	return append(topic, hex.EncodeToString(cor)...)
+}
+
+// Remove the waiting request and its temporary subscription, the late response would be discarded.
+func (r *Requester) cleanup(cor []byte, topic []byte) {
+	r.mu.Lock()
+	ch := r.mpw[string(cor)]
+	delete(r.mpw, string(cor))
+	r.mu.Unlock()
+
+	select {
+	case rsp := <-ch:
+		rsp.Release()
+	default:
+	}
+	<-r.sw.PeerNodeUnSubscribe(r.kadId.Pub, byte(0), topic)
+}
+
+// Hand over the response to the waiting request, return false if no request is waiting for it.
+func (r *Requester) dispatch(rsp *MessagePacket) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch, exist := r.mpw[string(rsp.CorrelationData())]
+	if !exist {
+		return false
+	}
+	select {
+	case ch <- rsp:
+		return true
+	default:
+		return false
+	}
+}
+
+// The provider of the requester's twin, which decodes the responses for the waiting requests.
+type replyProvider struct {
+	r *Requester
+}
+
+func (rp *replyProvider) KadID() *kademlia.ID {
+	return rp.r.kadId
+}
+
+func (rp *replyProvider) Push(data []byte) error {
+	rsp, err := UnmarshalMessagePacket(data)
+	if err != nil {
+		return err
+	}
+	if !rp.r.dispatch(rsp) {
+		rsp.Release()
+	}
+	return nil
+}
+
+// Create the response to the request, which carries the correlation data of the request to its response topic.
+func NewResponsePacket(req *MessagePacket, pubKadId *kademlia.ID, mid uint32, payLoad []byte) (*MessagePacket, error) {
+	req.mu.Lock()
+	qos, topic, cor := req.qos, req.rspTopic, req.corData
+	req.mu.Unlock()
+
+	if len(topic) == 0 {
+		return nil, ErrNoResponseTopic
+	}
+	rsp := NewMessagePacket(pubKadId, mid, qos, append([]byte(nil), topic...), payLoad)
+	rsp.SetCorrelationData(append([]byte(nil), cor...))
+	return rsp, nil
+}
@@ -0,0 +1,112 @@
+package marina
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TheSmallBoat/cabinet"
+	"github.com/lithdew/kademlia"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+// The provider responds the echo of the request payload.
+type echoProvider struct {
+	kadId *kademlia.ID
+	pw    *PublishWorker
+}
+
+func (p *echoProvider) KadID() *kademlia.ID {
+	return p.kadId
+}
+
+func (p *echoProvider) Push(data []byte) error {
+	req, err := UnmarshalMessagePacket(data)
+	if err != nil {
+		return err
+	}
+	defer req.Release()
+
+	rsp, err := NewResponsePacket(req, p.kadId, req.mid, append([]byte("echo:"), req.payLoad...))
+	if err != nil {
+		return err
+	}
+	return p.pw.WorkFor(rsp)
+}
+
+func TestRequester(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		err := tt.Close()
+		require.NoError(t, err)
+	}()
+
+	bKid, err := generateKadId()
+	require.NoError(t, err)
+	rKid, err := generateKadId()
+	require.NoError(t, err)
+	eKid, err := generateKadId()
+	require.NoError(t, err)
+
+	twp := NewTwinsPool()
+	defer twp.Close()
+	sw := NewSubscribeWorker(twp, tt)
+	defer sw.Close()
+	pw := NewPublishWorker(bKid, tt)
+	defer pw.Close()
+
+	var prd TwinServiceProvider = &echoProvider{kadId: eKid, pw: pw}
+	require.NoError(t, (<-sw.PeerNodeSubscribe(&prd, byte(1), []byte("/rpc/echo"))).Err)
+
+	rq := NewRequester(rKid, pw, sw)
+	require.NoError(t, rq.Start())
+	req := NewMessagePacket(rKid, uint32(1), byte(1), []byte("/rpc/echo"), []byte("xyz"))
+	rsp, err := rq.Request(req, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("echo:xyz"), rsp.payLoad)
+	require.Equal(t, req.ResponseTopic(), rsp.topic)
+	require.Equal(t, req.CorrelationData(), rsp.CorrelationData())
+	require.Equal(t, eKid.Pub, rsp.pubKadId.Pub)
+	rsp.Release()
+	pw.Wait()
+	req.Release()
+
+	// the temporary subscription has been removed
+	require.Empty(t, twp.SubscriptionsOf(rKid.Pub))
+	require.Equal(t, uint32(1), rq.rspNum)
+
+	// the twin of the requester is paired with its provider, and kept by the reconciling
+	twp.reconcile()
+	tw, exist := twp.existTwin(rKid.Pub)
+	require.True(t, exist)
+	require.True(t, tw.onlineStatus())
+
+	// no responder
+	req = NewMessagePacket(rKid, uint32(2), byte(0), []byte("/rpc/none"), []byte("xyz"))
+	_, err = rq.Request(req, 20*time.Millisecond)
+	require.True(t, errors.Is(err, ErrRequestTimeout))
+	require.Equal(t, uint32(2), rq.reqNum)
+	require.Equal(t, uint32(1), rq.tmoNum)
+	require.Empty(t, twp.SubscriptionsOf(rKid.Pub))
+	require.Empty(t, rq.mpw)
+	pw.Wait()
+	req.Release()
+
+	// the invalid request topic
+	req = NewMessagePacket(rKid, uint32(3), byte(0), []byte("/rpc/+"), []byte("xyz"))
+	_, err = rq.Request(req, time.Second)
+	require.True(t, errors.Is(err, ErrPublishTopicWildcard))
+	require.Empty(t, twp.SubscriptionsOf(rKid.Pub))
+	req.Release()
+
+	_, err = NewResponsePacket(req, eKid, uint32(4), []byte("xyz"))
+	require.True(t, errors.Is(err, ErrNoResponseTopic))
+	sw.Wait()
+
+	rq.Close()
+	_, exist = twp.existServiceProvider(rKid.Pub)
+	require.False(t, exist)
+}
@@ -0,0 +1,36 @@
+package marina
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+type RetryPolicy struct {
+	MaxAttempts int                  // The max attempts of the pushing operation, including the first one.
+	BaseBackoff time.Duration        // The backoff before the second attempt, doubled for each of the next attempts.
+	MaxBackoff  time.Duration        // The upper limit of the backoff, zero means unlimited.
+	Retryable   func(err error) bool // Report whether the error could be retried, nil means all of the errors.
+}
+
+func (rp *RetryPolicy) retryable(attempt int, err error) bool {
+	if err == nil || attempt >= rp.MaxAttempts {
+		return false
+	}
+	return rp.Retryable == nil || rp.Retryable(err)
+}
+
+// The backoff after the failed attempt, with the jitter in [d/2, d).
+func (rp *RetryPolicy) backoff(attempt int) time.Duration {
+	d := rp.BaseBackoff
+	for i := 1; i < attempt && d <= math.MaxInt64/2 && (rp.MaxBackoff <= 0 || d < rp.MaxBackoff); i++ {
+		d *= 2
+	}
+	if rp.MaxBackoff > 0 && d > rp.MaxBackoff {
+		d = rp.MaxBackoff
+	}
+	if d < 2 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
@@ -0,0 +1,41 @@
+package marina
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	errTemporary := errors.New("temporary")
+	errPermanent := errors.New("permanent")
+
+	rp := &RetryPolicy{MaxAttempts: 3, BaseBackoff: 8 * time.Millisecond, MaxBackoff: 20 * time.Millisecond}
+	require.Equal(t, false, rp.retryable(1, nil))
+	require.Equal(t, true, rp.retryable(1, errTemporary))
+	require.Equal(t, true, rp.retryable(2, errPermanent))
+	require.Equal(t, false, rp.retryable(3, errTemporary))
+
+	rp.Retryable = func(err error) bool { return err == errTemporary }
+	require.Equal(t, true, rp.retryable(1, errTemporary))
+	require.Equal(t, false, rp.retryable(1, errPermanent))
+
+	for i := 0; i < 16; i++ {
+		d := rp.backoff(1)
+		require.Equal(t, true, d >= 4*time.Millisecond && d < 8*time.Millisecond)
+		d = rp.backoff(2)
+		require.Equal(t, true, d >= 8*time.Millisecond && d < 16*time.Millisecond)
+		d = rp.backoff(3)
+		require.Equal(t, true, d >= 10*time.Millisecond && d < 20*time.Millisecond)
+	}
+
+	rp = &RetryPolicy{MaxAttempts: 100, BaseBackoff: time.Second}
+	require.Equal(t, true, rp.backoff(99) > 0)
+	rp = &RetryPolicy{MaxAttempts: 2}
+	require.Equal(t, time.Duration(0), rp.backoff(1))
+}
@@ -0,0 +1,165 @@
+package marina
+
+import (
+	"sync"
+)
+
+// The subscription of the peer-node with the options.
+type Subscription struct {
+	Topic             []byte
+	Qos               byte   // The maximum qos of the delivering, the higher qos of the message-packet is downgraded.
+	NoLocal           bool   // If true, the message-packets published by the peer-node itself are not delivered.
+	RetainAsPublished bool   // If true, the retain flag of the message-packet is kept, otherwise cleared.
+	SubscriptionID    uint32 // The identifier carried by the delivered message-packets, zero means none.
+}
+
+const defaultMaxSessionQueueSize = 1024 // The default max number of the data queued in the session.
+
+// The session of the peer-node keyed by the public key, records the subscriptions with the qos,
+// and queues the data while the twin is offline if the session is not clean.
+type session struct {
+	mu    sync.Mutex
+	clean bool // If true, the subscriptions and the queued data would not survive the disconnecting.
+
+	subs map[string]Subscription // The subscriptions keyed by the topic.
+	hq   [][]byte                // The queued high-priority data.
+	lq   [][]byte                // The queued low-priority data.
+	size int64                   // The bytes of the queued data.
+}
+
+func newSession() *session {
+	return &session{
+		mu:    sync.Mutex{},
+		clean: true,
+		subs:  make(map[string]Subscription),
+	}
+}
+
+func (s *session) isClean() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.clean
+}
+
+// The clean session discards the queued data, return the bytes of the discarded data.
+func (s *session) setClean(clean bool) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clean = clean
+	if !clean {
+		return 0
+	}
+	size := s.size
+	s.hq, s.lq, s.size = nil, nil, 0
+	return size
+}
+
+// Return the bytes of the queued data.
+func (s *session) queuedBytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size
+}
+
+// The subscription of the same topic would be replaced.
+func (s *session) addSubscription(sub Subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub.Topic = append([]byte(nil), sub.Topic...)
+	s.subs[string(sub.Topic)] = sub
+}
+
+func (s *session) hasSubscription(topic []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, exist := s.subs[string(topic)]
+	return exist
+}
+
+// Return false if the topic has not been subscribed.
+func (s *session) removeSubscription(topic []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, exist := s.subs[string(topic)]
+	delete(s.subs, string(topic))
+	return exist
+}
+
+// Return the number of the subscriptions.
+func (s *session) length() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.subs)
+}
+
+// Return the copy of the subscriptions.
+func (s *session) subscriptions() map[string]Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subs := make(map[string]Subscription, len(s.subs))
+	for topic, sub := range s.subs {
+		subs[topic] = sub
+	}
+	return subs
+}
+
+// Return the subscription matching the topic, the one with the highest qos wins among the overlapping ones,
+// and the smaller filter wins among the same qos.
+func (s *session) subscriptionFor(topic []byte) (Subscription, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var match Subscription
+	var matched bool
+	for filter, sub := range s.subs {
+		if !MatchTopic(sub.Topic, topic) {
+			continue
+		}
+		if !matched || sub.Qos > match.Qos || (sub.Qos == match.Qos && filter < string(match.Topic)) {
+			match, matched = sub, true
+		}
+	}
+	return match, matched
+}
+
+// Return false if the session is clean or the queue is full.
+func (s *session) enqueue(data []byte, priority Priority) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.clean || len(s.hq)+len(s.lq) >= defaultMaxSessionQueueSize {
+		return false
+	}
+	if priority == PriorityHigh {
+		s.hq = append(s.hq, data)
+	} else {
+		s.lq = append(s.lq, data)
+	}
+	s.size += int64(len(data))
+	return true
+}
+
+// Dequeue the data, the high-priority data first.
+func (s *session) dequeue() ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var data []byte
+	if len(s.hq) > 0 {
+		data, s.hq = s.hq[0], s.hq[1:]
+	} else if len(s.lq) > 0 {
+		data, s.lq = s.lq[0], s.lq[1:]
+	} else {
+		return nil, false
+	}
+	s.size -= int64(len(data))
+	return data, true
+}
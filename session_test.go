@@ -0,0 +1,84 @@
+package marina
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheSmallBoat/cabinet"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestSession(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		err := tt.Close()
+		require.NoError(t, err)
+	}()
+
+	twp := NewTwinsPool()
+	defer twp.Close()
+
+	sw := NewSubscribeWorker(twp, tt)
+	defer sw.Close()
+
+	gate := make(chan struct{})
+	close(gate)
+
+	kid1, err := generateKadId()
+	require.NoError(t, err)
+	kid2, err := generateKadId()
+	require.NoError(t, err)
+
+	var prd1 TwinServiceProvider = &gatedProvider{kadId: kid1, gate: gate}
+	var prd2 TwinServiceProvider = &gatedProvider{kadId: kid2, gate: gate}
+
+	// The persistent session.
+	twp.SetCleanSession(kid1.Pub, false)
+	sw.PeerNodeSubscribe(&prd1, byte(1), []byte("/finance/tom"))
+	sw.PeerNodeSubscribe(&prd2, byte(0), []byte("/finance/tom"))
+	sw.Wait()
+	require.Equal(t, uint32(2), sw.subSucNum)
+	require.Equal(t, []Subscription{{Topic: []byte("/finance/tom"), Qos: 1}}, twp.SubscriptionsOf(kid1.Pub))
+
+	tw1, exist := twp.existTwin(kid1.Pub)
+	require.True(t, exist)
+	tw1.turnToOffline()
+	require.NoError(t, tw1.pushMessagePacketToChannel([]byte("a")))
+	require.NoError(t, tw1.pushMessagePacketWithPriority([]byte("b"), PriorityHigh))
+
+	twp.release(tw1)
+	entities := make([]interface{}, 0)
+	require.NoError(t, tt.LinkedEntities([]byte("/finance/tom"), &entities))
+	require.Equal(t, 1, len(entities))
+
+	// The links and the queued data are restored against the new twin on reconnecting.
+	var prd3 TwinServiceProvider = &gatedProvider{kadId: kid1, gate: gate}
+	tw3 := twp.acquire(&prd3)
+	entities = entities[:0]
+	require.NoError(t, tt.LinkedEntities([]byte("/finance/tom"), &entities))
+	require.Equal(t, 2, len(entities))
+	require.Contains(t, entities, tw3)
+	require.Eventually(t, func() bool {
+		return len(prd3.(*gatedProvider).received()) == 2
+	}, time.Second, time.Millisecond)
+	require.Equal(t, [][]byte{[]byte("b"), []byte("a")}, prd3.(*gatedProvider).received())
+
+	// The clean session discards everything on disconnecting.
+	tw2, exist := twp.existTwin(kid2.Pub)
+	require.True(t, exist)
+	tw2.turnToOffline()
+	require.Error(t, tw2.pushMessagePacketToChannel([]byte("c")))
+	twp.release(tw2)
+	require.Empty(t, twp.SubscriptionsOf(kid2.Pub))
+	entities = entities[:0]
+	require.NoError(t, tt.LinkedEntities([]byte("/finance/tom"), &entities))
+	require.Equal(t, []interface{}{tw3}, entities)
+
+	sw.PeerNodeUnSubscribe(kid1.Pub, byte(0), []byte("/finance/tom"))
+	sw.Wait()
+	require.Equal(t, uint32(1), sw.unSubSucNum)
+	require.Empty(t, twp.session(kid1.Pub).subscriptions())
+}
@@ -0,0 +1,139 @@
+package marina
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+var sharePrefix = []byte("$share/")
+
+// The strategy to select the member of the shared subscription group for every message-packet.
+type ShareStrategy byte
+
+const (
+	ShareRoundRobin      ShareStrategy = iota // Select the members in turn.
+	ShareLeastQueueDepth                      // Select the member with the least queued data.
+	ShareHashByKey                            // Select the member by the hash of the publisher's public key.
+)
+
+func (s ShareStrategy) String() string {
+	switch s {
+	case ShareRoundRobin:
+		return "round-robin"
+	case ShareLeastQueueDepth:
+		return "least-queue-depth"
+	case ShareHashByKey:
+		return "hash-by-key"
+	default:
+		return fmt.Sprintf("share strategy %d", byte(s))
+	}
+}
+
+// Parse the shared subscription topic like '$share/group/filter', return false if it is not shared.
+func parseSharedTopic(topic []byte) ([]byte, []byte, bool, error) {
+	if !bytes.HasPrefix(topic, sharePrefix) {
+		return nil, nil, false, nil
+	}
+	rest := topic[len(sharePrefix):]
+	i := bytes.IndexByte(rest, '/')
+	if i < 1 || i == len(rest)-1 {
+		return nil, nil, true, fmt.Errorf("%w: the shared subscription '%s' needs the group and the filter", ErrInvalidTopicFilter, topic)
+	}
+	group := rest[:i]
+	if bytes.ContainsAny(group, "#+") {
+		return nil, nil, true, fmt.Errorf("%w: the group of the shared subscription '%s' contains the wildcard", ErrInvalidTopicFilter, topic)
+	}
+	return group, rest[i+1:], true, nil
+}
+
+// The group of the twins sharing one subscription, each message-packet goes to exactly one online member.
+// The group is linked to the topic tree as one entity.
+type shareGroup struct {
+	mu       sync.Mutex
+	name     []byte
+	filter   []byte
+	strategy ShareStrategy
+	members  []*twin
+	next     uint32 // The cursor of the round-robin strategy.
+}
+
+func newShareGroup(name []byte, filter []byte, strategy ShareStrategy) *shareGroup {
+	return &shareGroup{
+		mu:       sync.Mutex{},
+		name:     name,
+		filter:   filter,
+		strategy: strategy,
+		members:  make([]*twin, 0),
+	}
+}
+
+func (sg *shareGroup) setStrategy(strategy ShareStrategy) {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+
+	sg.strategy = strategy
+}
+
+func (sg *shareGroup) add(tw *twin) {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+
+	for _, m := range sg.members {
+		if m == tw {
+			return
+		}
+	}
+	sg.members = append(sg.members, tw)
+}
+
+// Return false if the twin is not the member, and whether the group becomes empty.
+func (sg *shareGroup) remove(tw *twin) (bool, bool) {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+
+	for i, m := range sg.members {
+		if m == tw {
+			sg.members = append(sg.members[:i], sg.members[i+1:]...)
+			return true, len(sg.members) == 0
+		}
+	}
+	return false, len(sg.members) == 0
+}
+
+// Select one online member for the message-packet by the strategy, return nil if all the members are offline.
+func (sg *shareGroup) pick(pkt *MessagePacket) *twin {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+
+	online := make([]*twin, 0, len(sg.members))
+	for _, m := range sg.members {
+		if m.onlineStatus() {
+			online = append(online, m)
+		}
+	}
+	if len(online) == 0 {
+		return nil
+	}
+
+	switch sg.strategy {
+	case ShareLeastQueueDepth:
+		least := online[0]
+		for _, m := range online[1:] {
+			if m.queueDepth() < least.queueDepth() {
+				least = m
+			}
+		}
+		return least
+	case ShareHashByKey:
+		h := fnv.New32a()
+		if pkt.pubKadId != nil {
+			_, _ = h.Write(pkt.pubKadId.Pub[:])
+		}
+		return online[h.Sum32()%uint32(len(online))]
+	default:
+		sg.next++
+		return online[sg.next%uint32(len(online))]
+	}
+}
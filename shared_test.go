@@ -0,0 +1,130 @@
+package marina
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheSmallBoat/cabinet"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestParseSharedTopic(t *testing.T) {
+	group, filter, shared, err := parseSharedTopic([]byte("$share/workers/finance/#"))
+	require.NoError(t, err)
+	require.True(t, shared)
+	require.Equal(t, []byte("workers"), group)
+	require.Equal(t, []byte("finance/#"), filter)
+
+	_, _, shared, err = parseSharedTopic([]byte("/finance/tom"))
+	require.NoError(t, err)
+	require.False(t, shared)
+
+	for _, topic := range []string{"$share/workers", "$share//finance", "$share/workers/", "$share/w+/finance"} {
+		_, _, shared, err = parseSharedTopic([]byte(topic))
+		require.True(t, shared)
+		require.Error(t, err, topic)
+	}
+}
+
+func TestSharedSubscription(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		err := tt.Close()
+		require.NoError(t, err)
+	}()
+
+	twp := NewTwinsPool()
+	defer twp.Close()
+
+	sw := NewSubscribeWorker(twp, tt)
+	defer sw.Close()
+
+	pKid, err1 := generateKadId()
+	require.NoError(t, err1)
+	bKid, err2 := generateKadId()
+	require.NoError(t, err2)
+
+	pw := NewPublishWorker(bKid, tt)
+	defer pw.Close()
+
+	gate := make(chan struct{})
+	close(gate)
+
+	members := make([]*gatedProvider, 3)
+	for i := range members {
+		kid, err := generateKadId()
+		require.NoError(t, err)
+		members[i] = &gatedProvider{kadId: kid, gate: gate}
+		var prd TwinServiceProvider = members[i]
+		result := <-sw.PeerNodeSubscribe(&prd, byte(0), []byte("$share/workers/finance/#"))
+		require.NoError(t, result.Err)
+	}
+	require.Equal(t, 1, pw.EntitiesNumFor([]byte("finance/tom")))
+
+	received := func() []int {
+		nums := make([]int, len(members))
+		for i, m := range members {
+			nums[i] = len(m.received())
+		}
+		return nums
+	}
+	publish := func(num int) {
+		for i := 0; i < num; i++ {
+			require.NoError(t, pw.WorkFor(NewMessagePacket(pKid, uint32(i), byte(0), []byte("finance/tom"), []byte("xyz"))))
+		}
+		pw.Wait()
+	}
+	total := func(nums []int) int {
+		sum := 0
+		for _, n := range nums {
+			sum += n
+		}
+		return sum
+	}
+
+	// round-robin
+	publish(30)
+	require.Eventually(t, func() bool { return total(received()) == 30 }, time.Second, time.Millisecond)
+	require.Equal(t, []int{10, 10, 10}, received())
+
+	// the offline member is skipped
+	tw0, exist := twp.existTwin(members[0].kadId.Pub)
+	require.True(t, exist)
+	tw0.turnToOffline()
+	publish(10)
+	require.Eventually(t, func() bool { return total(received()) == 40 }, time.Second, time.Millisecond)
+	require.Equal(t, 10, received()[0])
+	tw0.turnToOnline()
+
+	// hash by the publisher key
+	twp.SetShareStrategy("workers", ShareHashByKey)
+	before := received()
+	publish(10)
+	require.Eventually(t, func() bool { return total(received()) == 50 }, time.Second, time.Millisecond)
+	changed := 0
+	for i, n := range received() {
+		if n != before[i] {
+			require.Equal(t, before[i]+10, n)
+			changed++
+		}
+	}
+	require.Equal(t, 1, changed)
+
+	// least queue depth
+	twp.SetShareStrategy("workers", ShareLeastQueueDepth)
+	publish(10)
+	require.Eventually(t, func() bool { return total(received()) == 60 }, time.Second, time.Millisecond)
+	require.Equal(t, uint32(60), pw.fwdSucNum)
+
+	// the empty group is unlinked
+	for _, m := range members {
+		result := <-sw.PeerNodeUnSubscribe(m.kadId.Pub, byte(0), []byte("$share/workers/finance/#"))
+		require.NoError(t, result.Err)
+	}
+	require.Equal(t, 0, pw.EntitiesNumFor([]byte("finance/tom")))
+	require.Empty(t, twp.mpg)
+	sw.Wait()
+}
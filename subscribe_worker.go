@@ -4,7 +4,6 @@ import (
 	"sync"
 	"sync/atomic"
 
-	"github.com/TheSmallBoat/cabinet"
 	"github.com/lithdew/kademlia"
 )
 
@@ -13,73 +12,191 @@ const defaultMaxSubscribeWorkers = 4
 // The subscribe packets come from the peer-nodes.
 type SubscribeWorker struct {
 	tp  *taskPool
-	twp *TwinsPool
-	tt  *cabinet.TTree
+	twp *TwinsPool // the twins pool links the twins in the topic index
 
 	subSucNum   uint32 // the success count of the subscribing operation
 	subErrNum   uint32 // the error count of the subscribing operation
 	unSubSucNum uint32 // the success count of the unsubscribing operation
 	unSubErrNum uint32 // the error count of the unsubscribing operation
+	azDenNum    uint32 // the denied count of the authorization
+
+	mu  sync.RWMutex
+	az  Authorizer    // the authorizer for the subscribing operation, nil means allowing all
+	dnh DenialHandler // the handler for the denied subscribing operations
 
 	wg sync.WaitGroup
 }
 
-func NewSubscribeWorker(twp *TwinsPool, tTree *cabinet.TTree) *SubscribeWorker {
+func NewSubscribeWorker(twp *TwinsPool, tTree TopicIndex) *SubscribeWorker {
+	twp.bindTopicTree(tTree)
 	return &SubscribeWorker{
 		tp:          newTaskPool(defaultMaxSubscribeWorkers),
 		twp:         twp,
-		tt:          tTree,
 		subSucNum:   0,
 		subErrNum:   0,
 		unSubSucNum: 0,
 		unSubErrNum: 0,
+		azDenNum:    0,
 	}
 }
 
+// Set the authorizer consulted by every subscribing operation, and the handler for the denials.
+func (s *SubscribeWorker) SetAuthorizer(az Authorizer, handler DenialHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.az = az
+	s.dnh = handler
+}
+
 // kid : the subscribe-peer-node kadId
-func (s *SubscribeWorker) PeerNodeSubscribe(prd *TwinServiceProvider, qos byte, topic []byte) {
-	if qos == byte(1) {
-		// Todo:process response
-	}
+// Subscribe the topic with the qos and the default options.
+func (s *SubscribeWorker) PeerNodeSubscribe(prd *TwinServiceProvider, qos byte, topic []byte) <-chan SubscribeResult {
+	return s.PeerNodeSubscribeWithOptions(prd, Subscription{Topic: topic, Qos: qos})
+}
+
+// Subscribe the topic with the options, the qos of the subscription is the maximum qos of the delivering.
+func (s *SubscribeWorker) PeerNodeSubscribeWithOptions(prd *TwinServiceProvider, sub Subscription) <-chan SubscribeResult {
+	ch := make(chan SubscribeResult, 1)
 	s.wg.Add(1)
-	s.tp.submitTask(func() { processPeerNodeSubscribe(s, prd, topic) })
+	s.tp.submitTask(func() { ch <- processPeerNodeSubscribe(s, prd, sub) })
+	return ch
 }
 
-func (s *SubscribeWorker) PeerNodeUnSubscribe(pubK kademlia.PublicKey, qos byte, topic []byte) {
-	if qos == byte(1) {
-		// Todo:process response
-	}
+// Unsubscribe the topic of the peer-node, the qos is only echoed in the result.
+func (s *SubscribeWorker) PeerNodeUnSubscribe(pubK kademlia.PublicKey, qos byte, topic []byte) <-chan SubscribeResult {
+	ch := make(chan SubscribeResult, 1)
+	s.wg.Add(1)
+	s.tp.submitTask(func() { ch <- processPeerNodeUnSubscribe(s, pubK, qos, topic) })
+	return ch
+}
+
+// The result of the subscribing or unsubscribing operation for one topic, nil Err means success.
+// The Code carries the granted qos or the failure reason.
+// The returned channel receives the result once, and the provider implementing the AckReceiver receives it in the Ack too.
+type SubscribeResult struct {
+	Topic []byte
+	Qos   byte
+	Code  AckCode
+	Err   error
+}
+
+// Subscribe the topics with the per-topic options in one task, the channel receives the per-topic results once.
+func (s *SubscribeWorker) PeerNodeSubscribeBatch(prd *TwinServiceProvider, subs []Subscription) <-chan []SubscribeResult {
+	ch := make(chan []SubscribeResult, 1)
+	s.wg.Add(1)
+	s.tp.submitTask(func() { ch <- processPeerNodeSubscribeBatch(s, prd, subs) })
+	return ch
+}
 
+// Unsubscribe the topics in one task, the channel receives the per-topic results once.
+func (s *SubscribeWorker) PeerNodeUnSubscribeBatch(pubK kademlia.PublicKey, topics [][]byte) <-chan []SubscribeResult {
+	ch := make(chan []SubscribeResult, 1)
 	s.wg.Add(1)
-	s.tp.submitTask(func() { processPeerNodeUnSubscribe(s, pubK, topic) })
+	s.tp.submitTask(func() { ch <- processPeerNodeUnSubscribeBatch(s, pubK, topics) })
+	return ch
+}
+
+// Unsubscribe all the topics of the peer-node in one task, e.g. for the device resetting.
+// The channel receives the per-topic results once.
+func (s *SubscribeWorker) UnsubscribeAll(pubK kademlia.PublicKey) <-chan []SubscribeResult {
+	ch := make(chan []SubscribeResult, 1)
+	s.wg.Add(1)
+	s.tp.submitTask(func() {
+		subs := s.twp.SubscriptionsOf(pubK)
+		topics := make([][]byte, 0, len(subs))
+		for _, sub := range subs {
+			topics = append(topics, sub.Topic)
+		}
+		ch <- processPeerNodeUnSubscribeBatch(s, pubK, topics)
+	})
+	return ch
 }
 
 // To link the twin for the peer-node to this topic
-func processPeerNodeSubscribe(subW *SubscribeWorker, prd *TwinServiceProvider, topic []byte) {
+func processPeerNodeSubscribe(subW *SubscribeWorker, prd *TwinServiceProvider, sub Subscription) SubscribeResult {
+	defer subW.wg.Done()
+
+	result := subscribeTopic(subW, prd, sub)
+	acknowledge(prd, &Ack{Unsubscribe: false, Results: []SubscribeResult{result}})
+	return result
+}
+
+// To unlink the twin for the peer-node to this topic
+func processPeerNodeUnSubscribe(subW *SubscribeWorker, pubK kademlia.PublicKey, qos byte, topic []byte) SubscribeResult {
+	defer subW.wg.Done()
+
+	prd := subW.twp.providerOf(pubK)
+	result := unsubscribeTopic(subW, pubK, qos, topic)
+	acknowledge(prd, &Ack{Unsubscribe: true, Results: []SubscribeResult{result}})
+	return result
+}
+
+func processPeerNodeSubscribeBatch(subW *SubscribeWorker, prd *TwinServiceProvider, subs []Subscription) []SubscribeResult {
+	defer subW.wg.Done()
+
+	results := make([]SubscribeResult, 0, len(subs))
+	for _, sub := range subs {
+		results = append(results, subscribeTopic(subW, prd, sub))
+	}
+	acknowledge(prd, &Ack{Unsubscribe: false, Results: results})
+	return results
+}
+
+func processPeerNodeUnSubscribeBatch(subW *SubscribeWorker, pubK kademlia.PublicKey, topics [][]byte) []SubscribeResult {
 	defer subW.wg.Done()
 
-	err := subW.tt.EntityLink(topic, subW.twp.acquire(prd))
+	prd := subW.twp.providerOf(pubK)
+	results := make([]SubscribeResult, 0, len(topics))
+	for _, topic := range topics {
+		results = append(results, unsubscribeTopic(subW, pubK, 0, topic))
+	}
+	acknowledge(prd, &Ack{Unsubscribe: true, Results: results})
+	return results
+}
+
+func subscribeTopic(subW *SubscribeWorker, prd *TwinServiceProvider, sub Subscription) SubscribeResult {
+	var err error
+	if prd == nil || (*prd).KadID() == nil {
+		err = ErrUnknownTwin
+	} else if !subW.authorize((*prd).KadID().Pub, sub.Topic) {
+		err = ErrNotAuthorized
+	} else {
+		err = subW.twp.subscribe(prd, sub)
+	}
 	if err != nil {
 		atomic.AddUint32(&subW.subErrNum, uint32(1))
 	} else {
 		atomic.AddUint32(&subW.subSucNum, uint32(1))
 	}
+	return SubscribeResult{Topic: sub.Topic, Qos: sub.Qos, Code: ackCodeOf(sub.Qos, err), Err: err}
 }
 
-// To unlink the twin for the peer-node to this topic
-func processPeerNodeUnSubscribe(subW *SubscribeWorker, pubK kademlia.PublicKey, topic []byte) {
-	defer subW.wg.Done()
-
-	tw, exist := subW.twp.existTwin(pubK)
-	if exist {
-		err := subW.tt.EntityUnLink(topic, tw)
-		if err != nil {
-			atomic.AddUint32(&subW.unSubErrNum, uint32(1))
-		} else {
-			atomic.AddUint32(&subW.unSubSucNum, uint32(1))
-		}
-	} else {
+func unsubscribeTopic(subW *SubscribeWorker, pubK kademlia.PublicKey, qos byte, topic []byte) SubscribeResult {
+	err := subW.twp.unsubscribe(pubK, topic)
+	if err != nil {
 		atomic.AddUint32(&subW.unSubErrNum, uint32(1))
+	} else {
+		atomic.AddUint32(&subW.unSubSucNum, uint32(1))
+	}
+	return SubscribeResult{Topic: topic, Qos: qos, Code: ackCodeOf(0, err), Err: err}
+}
+
+func (s *SubscribeWorker) authorize(pubK kademlia.PublicKey, topic []byte) bool {
+	s.mu.RLock()
+	az, dnh := s.az, s.dnh
+	s.mu.RUnlock()
+
+	return authorize(az, dnh, &s.azDenNum, pubK, AccessSubscribe, topic)
+}
+
+// Push the ack to the provider if it implements the AckReceiver.
+func acknowledge(prd *TwinServiceProvider, ack *Ack) {
+	if prd == nil {
+		return
+	}
+	if ar, ok := (*prd).(AckReceiver); ok {
+		ar.ReceiveAck(ack)
 	}
 }
 
@@ -64,14 +64,14 @@ func TestSubscribeWorker(t *testing.T) {
 	require.Equal(t, uint32(3), sw.subSucNum)
 
 	entities := make([]interface{}, 0)
-	err := sw.tt.LinkedEntities([]byte("/finance/#"), &entities)
+	err := tt.LinkedEntities([]byte("/finance/#"), &entities)
 	require.NoError(t, err)
 	require.Equal(t, 1, len(entities))
 	twe := entities[0].(*twin)
 	require.Equal(t, twp.acquire(&prd3), twe)
 
 	entities = entities[0:0]
-	err = sw.tt.LinkedEntities([]byte("/finance/tom"), &entities)
+	err = tt.LinkedEntities([]byte("/finance/tom"), &entities)
 	require.NoError(t, err)
 	require.Equal(t, 2, len(entities))
 
@@ -85,7 +85,7 @@ func TestSubscribeWorker(t *testing.T) {
 	require.Equal(t, 2, i)
 
 	entities = entities[0:0]
-	err = sw.tt.LinkedEntities([]byte("/finance/jack"), &entities)
+	err = tt.LinkedEntities([]byte("/finance/jack"), &entities)
 	require.NoError(t, err)
 	require.Equal(t, 2, len(entities))
 
@@ -103,7 +103,7 @@ func TestSubscribeWorker(t *testing.T) {
 	require.Equal(t, uint32(1), sw.unSubSucNum)
 
 	entities = entities[0:0]
-	err = sw.tt.LinkedEntities([]byte("/finance/tom"), &entities)
+	err = tt.LinkedEntities([]byte("/finance/tom"), &entities)
 	require.NoError(t, err)
 	require.Equal(t, 1, len(entities))
 	twe = entities[0].(*twin)
@@ -119,7 +119,7 @@ func TestSubscribeWorker(t *testing.T) {
 	require.Equal(t, uint32(2), sw.unSubSucNum)
 
 	entities = entities[0:0]
-	err = sw.tt.LinkedEntities([]byte("/finance/tom"), &entities)
+	err = tt.LinkedEntities([]byte("/finance/tom"), &entities)
 	require.NoError(t, err)
 	require.Equal(t, 0, len(entities))
 
@@ -133,16 +133,16 @@ func TestSubscribeWorker(t *testing.T) {
 	require.Equal(t, uint32(9), sw.subSucNum)
 
 	entities = entities[0:0]
-	err = sw.tt.LinkedEntities([]byte("/finance/#/tom"), &entities)
+	err = tt.LinkedEntities([]byte("/finance/#/tom"), &entities)
 	require.Error(t, err)
 
 	entities = entities[0:0]
-	err = sw.tt.LinkedEntities([]byte("/finance/1/tom"), &entities)
+	err = tt.LinkedEntities([]byte("/finance/1/tom"), &entities)
 	require.NoError(t, err)
 	require.Equal(t, 2, len(entities))
 
 	entities = entities[0:0]
-	err = sw.tt.LinkedEntities([]byte("/finance/2/+"), &entities)
+	err = tt.LinkedEntities([]byte("/finance/2/+"), &entities)
 	require.NoError(t, err)
 	require.Equal(t, 1, len(entities))
 	twe = entities[0].(*twin)
@@ -161,3 +161,59 @@ func TestSubscribeWorker(t *testing.T) {
 	require.Equal(t, uint32(3), sw.unSubSucNum)
 	require.Equal(t, uint32(4), sw.unSubErrNum)
 }
+
+func TestSubscribeWorkerBatch(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		err := tt.Close()
+		require.NoError(t, err)
+	}()
+
+	twp := NewTwinsPool()
+	defer twp.Close()
+
+	sw := NewSubscribeWorker(twp, tt)
+	defer sw.Close()
+
+	kid1, err1 := generateKadId()
+	require.NoError(t, err1)
+
+	var prd1 TwinServiceProvider = &provider{kadId: kid1}
+
+	results := <-sw.PeerNodeSubscribeBatch(&prd1, []Subscription{
+		{Topic: []byte("/finance/tom"), Qos: 1},
+		{Topic: []byte("/finance/#/tom"), Qos: 0},
+		{Topic: []byte("/finance/jack"), Qos: 0},
+	})
+	require.Equal(t, 3, len(results))
+	require.NoError(t, results[0].Err)
+	require.Error(t, results[1].Err)
+	require.NoError(t, results[2].Err)
+	require.Equal(t, byte(1), results[0].Qos)
+	require.Equal(t, uint32(2), sw.subSucNum)
+	require.Equal(t, uint32(1), sw.subErrNum)
+	require.Equal(t, 2, len(twp.SubscriptionsOf(kid1.Pub)))
+
+	results = <-sw.PeerNodeUnSubscribeBatch(kid1.Pub, [][]byte{[]byte("/finance/tom"), []byte("/finance/mary")})
+	require.Equal(t, 2, len(results))
+	require.NoError(t, results[0].Err)
+	require.Error(t, results[1].Err)
+
+	<-sw.PeerNodeSubscribeBatch(&prd1, []Subscription{{Topic: []byte("/finance/+/tom"), Qos: 0}})
+	results = <-sw.UnsubscribeAll(kid1.Pub)
+	require.Equal(t, 2, len(results))
+	for _, r := range results {
+		require.NoError(t, r.Err)
+	}
+	require.Empty(t, twp.SubscriptionsOf(kid1.Pub))
+
+	entities := make([]interface{}, 0)
+	require.NoError(t, tt.LinkedEntities([]byte("/finance/jack"), &entities))
+	require.Empty(t, entities)
+
+	sw.Wait()
+	require.Equal(t, uint32(3), sw.unSubSucNum)
+	require.Equal(t, uint32(1), sw.unSubErrNum)
+}
@@ -9,7 +9,8 @@ const defaultTaskPoolSize = 32 // The default Pool size for the single task queu
 type taskPool struct {
 	maxWorkers  uint16
 	taskCounter uint32
-	taskQueue   []chan func()
+	taskQueue   []chan func() // The low-priority lane.
+	hTaskQueue  []chan func() // The high-priority lane, always drained before the low-priority lane.
 	exit        []chan struct{}
 }
 
@@ -22,6 +23,7 @@ func newTaskPool(maxWorkers uint16) *taskPool {
 		maxWorkers:  maxWorkers,
 		taskCounter: uint32(0),
 		taskQueue:   make([]chan func(), maxWorkers),
+		hTaskQueue:  make([]chan func(), maxWorkers),
 		exit:        make([]chan struct{}, maxWorkers),
 	}
 
@@ -34,7 +36,22 @@ func newTaskPool(maxWorkers uint16) *taskPool {
 func (tp *taskPool) executeTask(taskId uint16) {
 	go func() {
 		for {
+			// The high-priority tasks overtake the low-priority tasks.
 			select {
+			case task, ok := <-tp.hTaskQueue[taskId]:
+				if ok && task != nil {
+					task()
+				}
+				continue
+			default:
+			}
+
+			select {
+			case task, ok := <-tp.hTaskQueue[taskId]:
+				if ok && task != nil {
+					// Execute the task.
+					task()
+				}
 			case task, ok := <-tp.taskQueue[taskId]:
 				if ok && task != nil {
 					// Execute the task.
@@ -50,6 +67,7 @@ func (tp *taskPool) executeTask(taskId uint16) {
 func (tp *taskPool) dispatch() {
 	for i := uint16(0); i < tp.maxWorkers; i++ {
 		tp.taskQueue[i] = make(chan func(), defaultTaskPoolSize)
+		tp.hTaskQueue[i] = make(chan func(), defaultTaskPoolSize)
 		tp.exit[i] = make(chan struct{}, 0)
 		tp.executeTask(i)
 	}
@@ -67,7 +85,28 @@ func (tp *taskPool) getId() uint16 {
 }
 
 func (tp *taskPool) submitTask(task func()) {
+	tp.submitPriorityTask(task, PriorityLow)
+}
+
+func (tp *taskPool) submitPriorityTask(task func(), priority Priority) {
 	if task != nil {
-		tp.taskQueue[tp.getId()] <- task
+		if priority == PriorityHigh {
+			tp.hTaskQueue[tp.getId()] <- task
+		} else {
+			tp.taskQueue[tp.getId()] <- task
+		}
+	}
+}
+
+// Submit the task without blocking, return false if the queue is full.
+func (tp *taskPool) trySubmitTask(task func()) bool {
+	if task == nil {
+		return false
+	}
+	select {
+	case tp.taskQueue[tp.getId()] <- task:
+		return true
+	default:
+		return false
 	}
 }
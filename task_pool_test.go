@@ -57,3 +57,42 @@ func BenchmarkTaskPool(b *testing.B) {
 	}
 	wg.Wait()
 }
+
+func TestTaskPoolPriority(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var tp = newTaskPool(1)
+	defer tp.close()
+
+	var mu sync.Mutex
+	var order []Priority
+	var pwg sync.WaitGroup
+
+	gate := make(chan struct{})
+	pwg.Add(1)
+	tp.submitTask(func() {
+		<-gate
+		pwg.Done()
+	})
+
+	for i := 0; i < 4; i++ {
+		pwg.Add(2)
+		tp.submitPriorityTask(func() {
+			mu.Lock()
+			order = append(order, PriorityLow)
+			mu.Unlock()
+			pwg.Done()
+		}, PriorityLow)
+		tp.submitPriorityTask(func() {
+			mu.Lock()
+			order = append(order, PriorityHigh)
+			mu.Unlock()
+			pwg.Done()
+		}, PriorityHigh)
+	}
+	close(gate)
+	pwg.Wait()
+
+	require.Equal(t, []Priority{PriorityHigh, PriorityHigh, PriorityHigh, PriorityHigh,
+		PriorityLow, PriorityLow, PriorityLow, PriorityLow}, order)
+}
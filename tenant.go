@@ -0,0 +1,218 @@
+package marina
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lithdew/kademlia"
+)
+
+// The tenant of the peer-nodes which have not been assigned.
+const DefaultTenant = "default"
+
+var (
+	ErrUnknownTenant       = errors.New("the tenant is unknown")
+	ErrTenantQuotaExceeded = errors.New("the tenant quota is exceeded")
+)
+
+// The quota of the tenant, the zero value means unlimited.
+type TenantQuota struct {
+	MaxSubscriptions int     // The max number of the subscriptions of all the peer-nodes in the tenant.
+	MaxTwins         int     // The max number of the twins in the tenant.
+	PublishRate      float64 // The max message-packets per second published by the tenant.
+	PublishBurst     int     // The burst of the publishing, the zero value means one second of the rate.
+}
+
+// The tenant owns the namespace of the topics, the topics are prefixed by the tenant name as the first level
+// in the topic index, so that the peer-nodes never see or publish into the topics of the other tenants.
+// The peer-nodes always use the topics without the prefix.
+type tenant struct {
+	name   string
+	prefix []byte
+
+	mu    sync.RWMutex
+	quota TenantQuota
+	pb    *tokenBucket // The publishing shaper, nil means unlimited.
+
+	subNum  int32 // The number of the subscriptions.
+	twinNum int32 // The number of the twins.
+}
+
+func newTenant(name string, quota TenantQuota) *tenant {
+	tn := &tenant{
+		name:   name,
+		prefix: append([]byte(name), topicSeparator),
+		mu:     sync.RWMutex{},
+	}
+	tn.setQuota(quota)
+	return tn
+}
+
+func (tn *tenant) setQuota(quota TenantQuota) {
+	tn.mu.Lock()
+	defer tn.mu.Unlock()
+
+	tn.quota = quota
+	tn.pb = nil
+	if quota.PublishRate > 0 {
+		burst := quota.PublishBurst
+		if burst < 1 {
+			burst = int(quota.PublishRate)
+		}
+		tn.pb = newTokenBucket(quota.PublishRate, burst)
+	}
+}
+
+func (tn *tenant) getQuota() (TenantQuota, *tokenBucket) {
+	tn.mu.RLock()
+	defer tn.mu.RUnlock()
+
+	return tn.quota, tn.pb
+}
+
+// Return the topic in the namespace of the tenant, the shared subscription is prefixed by the filter part.
+func (tn *tenant) topic(topic []byte) []byte {
+	if tn == nil {
+		return topic
+	}
+	if group, filter, shared, err := parseSharedTopic(topic); err == nil && shared {
+		dst := make([]byte, 0, len(topic)+len(tn.prefix))
+		dst = append(dst, sharePrefix...)
+		dst = append(dst, group...)
+		dst = append(dst, topicSeparator)
+		dst = append(dst, tn.prefix...)
+		return append(dst, filter...)
+	}
+	dst := make([]byte, 0, len(topic)+len(tn.prefix))
+	dst = append(dst, tn.prefix...)
+	return append(dst, topic...)
+}
+
+// Reserve the counter under the max, return false if the quota is exceeded.
+func reserveQuota(counter *int32, max int) bool {
+	for {
+		n := atomic.LoadInt32(counter)
+		if max > 0 && int(n) >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(counter, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (tn *tenant) quotaError(what string, max int) error {
+	return fmt.Errorf("%w: the tenant '%s' has reached the max %d %s", ErrTenantQuotaExceeded, tn.name, max, what)
+}
+
+// Reserve one more twin, return the error if the quota is exceeded.
+func (tn *tenant) acquireTwin() error {
+	if tn == nil {
+		return nil
+	}
+	quota, _ := tn.getQuota()
+	if reserveQuota(&tn.twinNum, quota.MaxTwins) {
+		return nil
+	}
+	return tn.quotaError("twins", quota.MaxTwins)
+}
+
+func (tn *tenant) releaseTwin() {
+	if tn != nil {
+		atomic.AddInt32(&tn.twinNum, -1)
+	}
+}
+
+func (tn *tenant) addSubscription() error {
+	if tn == nil {
+		return nil
+	}
+	quota, _ := tn.getQuota()
+	if reserveQuota(&tn.subNum, quota.MaxSubscriptions) {
+		return nil
+	}
+	return tn.quotaError("subscriptions", quota.MaxSubscriptions)
+}
+
+func (tn *tenant) removeSubscriptions(num int) {
+	if tn != nil {
+		atomic.AddInt32(&tn.subNum, -int32(num))
+	}
+}
+
+func (tn *tenant) allowPublish() error {
+	if tn == nil {
+		return nil
+	}
+	quota, pb := tn.getQuota()
+	if pb == nil || pb.allow(1) {
+		return nil
+	}
+	return fmt.Errorf("%w: the tenant '%s' has reached the max publishing rate %g", ErrTenantQuotaExceeded, tn.name, quota.PublishRate)
+}
+
+// The registry of the tenants shared by the twins pool and the publish worker.
+// All the unassigned peer-nodes belong to the DefaultTenant.
+type Tenants struct {
+	mu  sync.RWMutex
+	mtn map[string]*tenant
+	mpk map[kademlia.PublicKey]*tenant
+}
+
+func NewTenants() *Tenants {
+	return &Tenants{
+		mu:  sync.RWMutex{},
+		mtn: map[string]*tenant{DefaultTenant: newTenant(DefaultTenant, TenantQuota{})},
+		mpk: make(map[kademlia.PublicKey]*tenant),
+	}
+}
+
+// Add the tenant with the quota, the quota of the existing tenant would be replaced.
+// The name is one topic level, which cannot be empty, contain the wildcards or start with the '$'
+// reserved for the broker topics.
+func (ts *Tenants) Add(name string, quota TenantQuota) error {
+	if name == "" || name[0] == '$' || bytes.ContainsAny([]byte(name), "/+#") {
+		return fmt.Errorf("the tenant name '%s' is invalid", name)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if tn, exist := ts.mtn[name]; exist {
+		tn.setQuota(quota)
+		return nil
+	}
+	ts.mtn[name] = newTenant(name, quota)
+	return nil
+}
+
+// Assign the peer-node to the tenant, which should happen before the peer-node subscribes or publishes.
+func (ts *Tenants) Assign(pubK kademlia.PublicKey, name string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	tn, exist := ts.mtn[name]
+	if !exist {
+		return fmt.Errorf("%w: '%s'", ErrUnknownTenant, name)
+	}
+	ts.mpk[pubK] = tn
+	return nil
+}
+
+// Return the tenant of the peer-node, nil if the tenants are not used.
+func (ts *Tenants) tenantOf(pubK kademlia.PublicKey) *tenant {
+	if ts == nil {
+		return nil
+	}
+
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	if tn, exist := ts.mpk[pubK]; exist {
+		return tn
+	}
+	return ts.mtn[DefaultTenant]
+}
@@ -0,0 +1,176 @@
+package marina
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TheSmallBoat/cabinet"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestTenants(t *testing.T) {
+	tns := NewTenants()
+	require.Error(t, tns.Add("", TenantQuota{}))
+	require.Error(t, tns.Add("a/b", TenantQuota{}))
+	require.Error(t, tns.Add("a+", TenantQuota{}))
+	require.Error(t, tns.Add("$SYS", TenantQuota{}))
+	require.NoError(t, tns.Add("acme", TenantQuota{}))
+
+	kid, err := generateKadId()
+	require.NoError(t, err)
+	require.True(t, errors.Is(tns.Assign(kid.Pub, "beta"), ErrUnknownTenant))
+	require.Equal(t, DefaultTenant, tns.tenantOf(kid.Pub).name)
+	require.NoError(t, tns.Assign(kid.Pub, "acme"))
+
+	tn := tns.tenantOf(kid.Pub)
+	require.Equal(t, []byte("acme//finance/tom"), tn.topic([]byte("/finance/tom")))
+	require.Equal(t, []byte("$share/workers/acme/finance/#"), tn.topic([]byte("$share/workers/finance/#")))
+	require.Equal(t, []byte("finance"), (*Tenants)(nil).tenantOf(kid.Pub).topic([]byte("finance")))
+}
+
+func TestTenantsIsolation(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		err := tt.Close()
+		require.NoError(t, err)
+	}()
+
+	tns := NewTenants()
+	require.NoError(t, tns.Add("acme", TenantQuota{MaxSubscriptions: 2}))
+	require.NoError(t, tns.Add("beta", TenantQuota{MaxTwins: 1, PublishRate: 1, PublishBurst: 1}))
+
+	twp := NewTwinsPool()
+	defer twp.Close()
+	twp.SetTenants(tns)
+
+	sw := NewSubscribeWorker(twp, tt)
+	defer sw.Close()
+
+	bKid, err := generateKadId()
+	require.NoError(t, err)
+	pw := NewPublishWorker(bKid, tt)
+	defer pw.Close()
+	pw.SetTenants(tns)
+
+	gate := make(chan struct{})
+	close(gate)
+	gps := make([]*gatedProvider, 4)
+	prds := make([]TwinServiceProvider, 4)
+	for i := range gps {
+		kid, err := generateKadId()
+		require.NoError(t, err)
+		gps[i] = &gatedProvider{kadId: kid, gate: gate}
+		prds[i] = gps[i]
+	}
+	require.NoError(t, tns.Assign(gps[0].kadId.Pub, "acme"))
+	require.NoError(t, tns.Assign(gps[1].kadId.Pub, "beta"))
+	require.NoError(t, tns.Assign(gps[3].kadId.Pub, "beta"))
+
+	// everyone subscribes all the topics, but only in the own namespace
+	for i := 0; i < 3; i++ {
+		require.NoError(t, (<-sw.PeerNodeSubscribe(&prds[i], byte(0), []byte("#"))).Err)
+	}
+	require.NoError(t, (<-sw.PeerNodeSubscribe(&prds[0], byte(0), []byte("/news"))).Err)
+	result := <-sw.PeerNodeSubscribe(&prds[0], byte(0), []byte("/sports"))
+	require.True(t, errors.Is(result.Err, ErrTenantQuotaExceeded))
+	require.Equal(t, AckQuotaExceeded, result.Code)
+	result = <-sw.PeerNodeSubscribe(&prds[3], byte(0), []byte("#"))
+	require.Equal(t, AckQuotaExceeded, result.Code)
+	require.Empty(t, twp.SubscriptionsOf(gps[3].kadId.Pub))
+
+	require.NoError(t, pw.WorkFor(NewMessagePacket(gps[0].kadId, uint32(1), byte(0), []byte("/news"), []byte("acme"))))
+	require.NoError(t, pw.WorkFor(NewMessagePacket(gps[1].kadId, uint32(2), byte(0), []byte("/news"), []byte("beta"))))
+	require.True(t, errors.Is(pw.WorkFor(NewMessagePacket(gps[1].kadId, uint32(3), byte(0), []byte("/news"), []byte("beta"))), ErrTenantQuotaExceeded))
+	require.Equal(t, uint32(1), pw.tqRejNum)
+	pw.Wait()
+
+	require.Eventually(t, func() bool {
+		return len(gps[0].received()) == 2 && len(gps[1].received()) == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, 0, len(gps[2].received()))
+
+	// the topic is delivered without the prefix
+	pkt, err := UnmarshalMessagePacket(gps[1].received()[0])
+	require.NoError(t, err)
+	defer pkt.Release()
+	require.Equal(t, []byte("/news"), pkt.topic)
+	require.Equal(t, []byte("beta"), pkt.payLoad)
+
+	// the released twin returns the quotas
+	tw1, exist := twp.existTwin(gps[1].kadId.Pub)
+	require.True(t, exist)
+	twp.release(tw1)
+	require.NoError(t, (<-sw.PeerNodeSubscribe(&prds[3], byte(0), []byte("#"))).Err)
+
+	require.NoError(t, (<-sw.PeerNodeUnSubscribe(gps[0].kadId.Pub, byte(0), []byte("/news"))).Err)
+	require.NoError(t, (<-sw.PeerNodeSubscribe(&prds[0], byte(0), []byte("/sports"))).Err)
+	sw.Wait()
+}
+
+func TestTenantsDeadLetter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		err := tt.Close()
+		require.NoError(t, err)
+	}()
+
+	tns := NewTenants()
+	require.NoError(t, tns.Add("acme", TenantQuota{}))
+	require.NoError(t, tns.Add("beta", TenantQuota{}))
+
+	twp := NewTwinsPool()
+	defer twp.Close()
+	twp.SetTenants(tns)
+
+	sw := NewSubscribeWorker(twp, tt)
+	defer sw.Close()
+
+	bKid, err := generateKadId()
+	require.NoError(t, err)
+	pw := NewPublishWorker(bKid, tt)
+	defer pw.Close()
+	pw.SetTenants(tns)
+	pw.SetDeadLetterHandler(NewDeadLetterTopic(pw, []byte("/dead/letter")))
+
+	gate := make(chan struct{})
+	close(gate)
+	gps := make([]*gatedProvider, 3)
+	prds := make([]TwinServiceProvider, 3)
+	for i := range gps {
+		kid, err := generateKadId()
+		require.NoError(t, err)
+		gps[i] = &gatedProvider{kadId: kid, gate: gate}
+		prds[i] = gps[i]
+	}
+	require.NoError(t, tns.Assign(gps[0].kadId.Pub, "acme"))
+	require.NoError(t, tns.Assign(gps[1].kadId.Pub, "beta"))
+	for i := range prds {
+		require.NoError(t, (<-sw.PeerNodeSubscribe(&prds[i], byte(0), []byte("/dead/letter"))).Err)
+	}
+	sw.Wait()
+
+	// the dead letter of the publisher goes to the namespace of its own tenant only
+	pKid, err := generateKadId()
+	require.NoError(t, err)
+	require.NoError(t, tns.Assign(pKid.Pub, "beta"))
+	require.NoError(t, pw.WorkFor(NewMessagePacket(pKid, uint32(1), byte(0), []byte("/finance/tom"), []byte("xyz"))))
+	pw.Wait()
+
+	require.Eventually(t, func() bool { return len(gps[1].received()) == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, 0, len(gps[0].received()))
+	require.Equal(t, 0, len(gps[2].received()))
+
+	pkt, err := UnmarshalMessagePacket(gps[1].received()[0])
+	require.NoError(t, err)
+	defer pkt.Release()
+	require.Equal(t, []byte("/dead/letter"), pkt.topic)
+	dl, err := UnmarshalDeadLetter(pkt.payLoad)
+	require.NoError(t, err)
+	require.Equal(t, DeadLetterNoSubscriber, dl.Reason)
+}
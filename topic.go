@@ -0,0 +1,149 @@
+package marina
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"unicode/utf8"
+)
+
+// The topic rules, consistent with the cabinet.TTree:
+//   - The topic levels are separated by the '/', and the empty level (e.g. the leading '/') matches like the '+'.
+//   - The single-level wildcard '+' matches exactly one level, and must occupy the entire level.
+//   - The multi-level wildcard '#' matches one or more remaining levels, and must be the entire last level.
+//   - The wildcards are only allowed in the topic filters for subscribing, never in the topics for publishing.
+//   - The shared subscription filter '$share/group/filter' follows the rules by the filter part.
+const (
+	topicSeparator      = '/'
+	singleLevelWildcard = '+'
+	multiLevelWildcard  = '#'
+	maxTopicLength      = math.MaxUint16 // The topic length is encoded as the uint16 in the message-packet.
+)
+
+var singleLevelWildcardLevel = []byte{singleLevelWildcard}
+
+var (
+	ErrEmptyTopic                = errors.New("the topic is empty")
+	ErrTopicTooLong              = errors.New("the topic is too long")
+	ErrTopicInvalidCharacter     = errors.New("the topic contains the null character or the invalid utf-8")
+	ErrWildcardNotEntireLevel    = errors.New("the wildcard must occupy the entire topic level")
+	ErrMultiLevelWildcardNotLast = errors.New("the multi-level wildcard must be the last topic level")
+	ErrPublishTopicWildcard      = errors.New("the topic for publishing cannot contain the wildcard")
+)
+
+// The error of the topic validation, which matches the ErrInvalidTopicFilter by errors.Is if it is a filter.
+type TopicError struct {
+	Topic  []byte
+	Filter bool
+	Err    error
+}
+
+func (e *TopicError) Error() string {
+	return fmt.Sprintf("the topic '%s': %s", e.Topic, e.Err)
+}
+
+func (e *TopicError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TopicError) Is(target error) bool {
+	return e.Filter && target == ErrInvalidTopicFilter
+}
+
+// Validate the topic filter for subscribing, return the *TopicError if it is invalid.
+func ValidateTopicFilter(filter []byte) error {
+	if err := validateTopic(filter, true); err != nil {
+		return &TopicError{Topic: filter, Filter: true, Err: err}
+	}
+	return nil
+}
+
+// Validate the topic for publishing, return the *TopicError if it is invalid.
+func ValidateTopicName(topic []byte) error {
+	if err := validateTopic(topic, false); err != nil {
+		return &TopicError{Topic: topic, Filter: false, Err: err}
+	}
+	return nil
+}
+
+func validateTopic(topic []byte, filter bool) error {
+	if filter {
+		_, f, shared, err := parseSharedTopic(topic)
+		if err != nil {
+			return err
+		}
+		if shared {
+			topic = f
+		}
+	}
+	if len(topic) == 0 {
+		return ErrEmptyTopic
+	}
+	if len(topic) > maxTopicLength {
+		return ErrTopicTooLong
+	}
+	if bytes.IndexByte(topic, 0) >= 0 || !utf8.Valid(topic) {
+		return ErrTopicInvalidCharacter
+	}
+	return validateTopicLevels(topic, filter)
+}
+
+// Validate the wildcards in the topic levels.
+func validateTopicLevels(topic []byte, filter bool) error {
+	levels := bytes.Split(topic, []byte{topicSeparator})
+	for i, level := range levels {
+		if bytes.IndexByte(level, singleLevelWildcard) < 0 && bytes.IndexByte(level, multiLevelWildcard) < 0 {
+			continue
+		}
+		if !filter {
+			return ErrPublishTopicWildcard
+		}
+		if len(level) != 1 {
+			return ErrWildcardNotEntireLevel
+		}
+		if level[0] == multiLevelWildcard && i != len(levels)-1 {
+			return ErrMultiLevelWildcardNotLast
+		}
+	}
+	return nil
+}
+
+// Return the next topic level and the remaining levels, the empty level is returned as the '+' like the cabinet.
+func nextTopicLevel(topic []byte) ([]byte, []byte) {
+	i := bytes.IndexByte(topic, topicSeparator)
+	switch {
+	case i < 0:
+		return topic, nil
+	case i == 0:
+		return singleLevelWildcardLevel, topic[1:]
+	default:
+		return topic[:i], topic[i+1:]
+	}
+}
+
+// Return true if the topic for publishing matches the topic filter, by the same rules as the topic tree.
+// The shared subscription filter matches by the filter part.
+func MatchTopic(filter []byte, topic []byte) bool {
+	if _, f, shared, err := parseSharedTopic(filter); err != nil {
+		return false
+	} else if shared {
+		filter = f
+	}
+
+	for len(filter) > 0 {
+		var fl, tl []byte
+		fl, filter = nextTopicLevel(filter)
+		if len(fl) == 1 && fl[0] == multiLevelWildcard {
+			return len(topic) > 0
+		}
+		if len(topic) == 0 {
+			return false
+		}
+		tl, topic = nextTopicLevel(topic)
+		if !(len(fl) == 1 && fl[0] == singleLevelWildcard) && !bytes.Equal(fl, tl) {
+			return false
+		}
+	}
+	return len(topic) == 0
+}
@@ -0,0 +1,173 @@
+package marina
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/TheSmallBoat/cabinet"
+)
+
+// The index of the topic filters for linking the entities, e.g. the twins and the shared subscription groups.
+// The method set is the same as the cabinet.TTree, which satisfies it directly.
+type TopicIndex interface {
+	EntityLink(topic []byte, entity interface{}) error
+	EntityUnLink(topic []byte, entity interface{}) error
+	// Reset the entities, then append the entities linked to the filters matching the topic.
+	LinkedEntities(topic []byte, entities *[]interface{}) error
+	Close() error
+}
+
+var _ TopicIndex = (*cabinet.TTree)(nil)
+
+// The optional extension of the TopicIndex, which returns the matched subscribers sorted by the type,
+// so that the publish worker forwards them without the type switch, e.g. the MatchCache or the wrapper embedding it.
+type typedMatcher interface {
+	match(topic []byte) (*matchEntry, error)
+}
+
+// Return the topic index backed by the cabinet.TTree.
+func NewCabinetTopicIndex() TopicIndex {
+	return cabinet.NewTopicTree()
+}
+
+var errNilEntity = errors.New("the entity cannot be nil")
+
+// The built-in trie of the topic filters, which follows the same topic rules as the cabinet.TTree.
+// The entities must be comparable.
+type TopicTrie struct {
+	mu   sync.RWMutex
+	root *trieNode
+}
+
+type trieNode struct {
+	entities []interface{}
+	next     map[string]*trieNode
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{
+		entities: make([]interface{}, 0),
+		next:     make(map[string]*trieNode),
+	}
+}
+
+func NewTopicTrie() *TopicTrie {
+	return &TopicTrie{
+		mu:   sync.RWMutex{},
+		root: newTrieNode(),
+	}
+}
+
+func (tt *TopicTrie) EntityLink(topic []byte, entity interface{}) error {
+	if entity == nil {
+		return errNilEntity
+	}
+	if err := validateTopicLevels(topic, true); err != nil {
+		return err
+	}
+
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	tn := tt.root
+	for rem := topic; len(rem) > 0; {
+		var level []byte
+		level, rem = nextTopicLevel(rem)
+		nn, exist := tn.next[string(level)]
+		if !exist {
+			nn = newTrieNode()
+			tn.next[string(level)] = nn
+		}
+		tn = nn
+	}
+	for _, e := range tn.entities {
+		if e == entity {
+			return nil
+		}
+	}
+	tn.entities = append(tn.entities, entity)
+	return nil
+}
+
+// Unlink the entity from the topic, the nil entity means all of the entities.
+func (tt *TopicTrie) EntityUnLink(topic []byte, entity interface{}) error {
+	if err := validateTopicLevels(topic, true); err != nil {
+		return err
+	}
+
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	return tt.root.remove(topic, entity)
+}
+
+func (tn *trieNode) remove(topic []byte, entity interface{}) error {
+	if len(topic) == 0 {
+		if entity == nil {
+			tn.entities = tn.entities[0:0]
+			return nil
+		}
+		for i, e := range tn.entities {
+			if e == entity {
+				tn.entities = append(tn.entities[:i], tn.entities[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("no topic found for the entity")
+	}
+
+	level, rem := nextTopicLevel(topic)
+	nn, exist := tn.next[string(level)]
+	if !exist {
+		return fmt.Errorf("no topic found")
+	}
+	if err := nn.remove(rem, entity); err != nil {
+		return err
+	}
+	if len(nn.entities) == 0 && len(nn.next) == 0 {
+		delete(tn.next, string(level))
+	}
+	return nil
+}
+
+func (tt *TopicTrie) LinkedEntities(topic []byte, entities *[]interface{}) error {
+	if err := validateTopicLevels(topic, true); err != nil {
+		return err
+	}
+
+	tt.mu.RLock()
+	defer tt.mu.RUnlock()
+
+	*entities = (*entities)[0:0]
+	tt.root.match(topic, entities)
+	return nil
+}
+
+func (tn *trieNode) match(topic []byte, entities *[]interface{}) {
+	if len(topic) == 0 {
+		*entities = append(*entities, tn.entities...)
+		return
+	}
+
+	level, rem := nextTopicLevel(topic)
+	if nn, exist := tn.next[string(multiLevelWildcard)]; exist {
+		*entities = append(*entities, nn.entities...)
+	}
+	if nn, exist := tn.next[string(singleLevelWildcard)]; exist {
+		nn.match(rem, entities)
+	}
+	if len(level) != 1 || (level[0] != singleLevelWildcard && level[0] != multiLevelWildcard) {
+		if nn, exist := tn.next[string(level)]; exist {
+			nn.match(rem, entities)
+		}
+	}
+}
+
+func (tt *TopicTrie) Close() error {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	tt.root = newTrieNode()
+	return nil
+}
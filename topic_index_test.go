@@ -0,0 +1,96 @@
+package marina
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/TheSmallBoat/cabinet"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func sortedEntities(t *testing.T, ti TopicIndex, topic string) []string {
+	entities := make([]interface{}, 0)
+	require.NoError(t, ti.LinkedEntities([]byte(topic), &entities))
+	names := make([]string, 0, len(entities))
+	for _, e := range entities {
+		names = append(names, e.(string))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestTopicTrie(t *testing.T) {
+	filters := []string{"finance", "finance/tom", "/finance/tom", "+/tom", "+/+", "finance/#", "#", "+", "/+/tom", "+/finance/#", "finance/+/tom/#"}
+	topics := []string{"finance", "finance/tom", "/finance/tom", "finance/jack", "finance/1/tom", "finance/1/tom/x", "a//b", "tom", "/tom", "finance/", "finance/+", "finance/#"}
+
+	// The trie is consistent with the cabinet.
+	ct := cabinet.NewTopicTree()
+	tr := NewTopicTrie()
+	for i := range filters {
+		require.NoError(t, ct.EntityLink([]byte(filters[i]), filters[i]))
+		require.NoError(t, tr.EntityLink([]byte(filters[i]), filters[i]))
+	}
+	require.NoError(t, tr.EntityLink([]byte("finance"), "finance"))
+	for _, topic := range topics {
+		require.Equal(t, sortedEntities(t, ct, topic), sortedEntities(t, tr, topic), topic)
+	}
+
+	require.Error(t, tr.EntityLink([]byte("finance/#/tom"), "x"))
+	require.Error(t, tr.EntityLink([]byte("finance"), nil))
+	require.Error(t, tr.EntityUnLink([]byte("finance/jack"), "finance"))
+	require.Error(t, tr.EntityUnLink([]byte("finance"), "jack"))
+
+	for i := range filters {
+		require.NoError(t, ct.EntityUnLink([]byte(filters[i]), filters[i]))
+		require.NoError(t, tr.EntityUnLink([]byte(filters[i]), filters[i]))
+	}
+	require.Empty(t, tr.root.next)
+	require.NoError(t, ct.Close())
+	require.NoError(t, tr.Close())
+}
+
+func TestWorkersWithTopicTrie(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var ti TopicIndex = NewTopicTrie()
+	defer func() {
+		err := ti.Close()
+		require.NoError(t, err)
+	}()
+
+	twp := NewTwinsPool()
+	defer twp.Close()
+
+	sw := NewSubscribeWorker(twp, ti)
+	defer sw.Close()
+
+	pKid, err1 := generateKadId()
+	require.NoError(t, err1)
+	bKid, err2 := generateKadId()
+	require.NoError(t, err2)
+	sKid, err3 := generateKadId()
+	require.NoError(t, err3)
+
+	pw := NewPublishWorker(bKid, ti)
+	defer pw.Close()
+
+	gate := make(chan struct{})
+	close(gate)
+	gp := &gatedProvider{kadId: sKid, gate: gate}
+	var prd TwinServiceProvider = gp
+
+	result := <-sw.PeerNodeSubscribe(&prd, byte(0), []byte("/finance/+"))
+	require.NoError(t, result.Err)
+	require.Equal(t, 1, pw.EntitiesNumFor([]byte("/finance/tom")))
+
+	require.NoError(t, pw.WorkFor(NewMessagePacket(pKid, uint32(1), byte(0), []byte("/finance/tom"), []byte("xyz"))))
+	pw.Wait()
+	require.Eventually(t, func() bool { return len(gp.received()) == 1 }, time.Second, time.Millisecond)
+
+	result = <-sw.PeerNodeUnSubscribe(sKid.Pub, byte(0), []byte("/finance/+"))
+	require.NoError(t, result.Err)
+	require.Equal(t, 0, pw.EntitiesNumFor([]byte("/finance/tom")))
+	sw.Wait()
+}
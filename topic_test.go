@@ -0,0 +1,75 @@
+package marina
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/TheSmallBoat/cabinet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateTopic(t *testing.T) {
+	for _, filter := range []string{"finance", "/finance/tom", "finance/+/tom", "finance/#", "#", "+", "$share/workers/finance/#"} {
+		require.NoError(t, ValidateTopicFilter([]byte(filter)), filter)
+	}
+	for filter, target := range map[string]error{
+		"":                   ErrEmptyTopic,
+		"finance/to#":        ErrWildcardNotEntireLevel,
+		"finance/+tom":       ErrWildcardNotEntireLevel,
+		"finance/#/tom":      ErrMultiLevelWildcardNotLast,
+		"finance/\x00":       ErrTopicInvalidCharacter,
+		"finance/\xff":       ErrTopicInvalidCharacter,
+		"$share/workers/#/a": ErrMultiLevelWildcardNotLast,
+		"$share/workers":     ErrInvalidTopicFilter,
+	} {
+		err := ValidateTopicFilter([]byte(filter))
+		require.True(t, errors.Is(err, target), filter)
+		require.True(t, errors.Is(err, ErrInvalidTopicFilter), filter)
+	}
+	require.True(t, errors.Is(ValidateTopicFilter([]byte(strings.Repeat("a", maxTopicLength+1))), ErrTopicTooLong))
+
+	require.NoError(t, ValidateTopicName([]byte("/finance/tom")))
+	err := ValidateTopicName([]byte("finance/+"))
+	require.True(t, errors.Is(err, ErrPublishTopicWildcard))
+	require.False(t, errors.Is(err, ErrInvalidTopicFilter))
+	var te *TopicError
+	require.True(t, errors.As(err, &te))
+	require.Equal(t, []byte("finance/+"), te.Topic)
+}
+
+func TestMatchTopic(t *testing.T) {
+	require.True(t, MatchTopic([]byte("finance/+/tom"), []byte("finance/1/tom")))
+	require.True(t, MatchTopic([]byte("$share/workers/finance/#"), []byte("finance/1/tom")))
+	require.False(t, MatchTopic([]byte("finance/#"), []byte("finance")))
+	require.False(t, MatchTopic([]byte("finance/+"), []byte("finance/1/tom")))
+
+	// The matcher is consistent with the topic tree.
+	filters := []string{"finance", "finance/tom", "/finance/tom", "+/tom", "+/+", "finance/#", "#", "+", "/+/tom", "+/finance/#", "finance/+/tom/#"}
+	topics := []string{"finance", "finance/tom", "/finance/tom", "finance/jack", "finance/1/tom", "finance/1/tom/x", "a//b", "tom", "/tom", "finance/"}
+
+	tt := cabinet.NewTopicTree()
+	for i := range filters {
+		require.NoError(t, tt.EntityLink([]byte(filters[i]), filters[i]))
+	}
+	for _, topic := range topics {
+		entities := make([]interface{}, 0)
+		require.NoError(t, tt.LinkedEntities([]byte(topic), &entities))
+		for _, filter := range filters {
+			require.Equal(t, contains(entities, filter), MatchTopic([]byte(filter), []byte(topic)), "%s %s", filter, topic)
+		}
+	}
+	for i := range filters {
+		require.NoError(t, tt.EntityUnLink([]byte(filters[i]), filters[i]))
+	}
+	require.NoError(t, tt.Close())
+}
+
+func contains(entities []interface{}, e interface{}) bool {
+	for _, v := range entities {
+		if v == e {
+			return true
+		}
+	}
+	return false
+}
@@ -1,23 +1,42 @@
 package marina
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-const defaultTwinChannelSize = 32 // The default channel size for the twin.
+const defaultTwinChannelSize = 32                 // The default channel size for the twin.
+const defaultCircuitBreakerInterval = time.Second // The default interval of probing the provider.
+
+var ErrTwinOverflow = errors.New("the channel of the twin is full")
+
+// The policy for the pushing operation while the channel of the twin is full.
+type OverflowPolicy byte
+
+const (
+	OverflowBlock      OverflowPolicy = iota // Block the pushing operation until the channel has room or the twin turns to offline.
+	OverflowDropOldest                       // Drop the oldest data in the channel to the dead letter, and push the new one.
+	OverflowDropNewest                       // Drop the new data to the dead letter, return the ErrTwinOverflow.
+	OverflowSpill                            // Spill the new data into the persistent session, the data would overtake the data in the channel.
+)
 
 type twin struct {
 	prd *TwinServiceProvider
 
-	tc   chan []byte   // The channel in the twin for receiving the data.
-	exit chan struct{} // The channel in the twin for the exit signal of the task.
+	tc   chan []byte    // The channel in the twin for receiving the low-priority data.
+	htc  chan []byte    // The channel in the twin for receiving the high-priority data.
+	exit chan struct{}  // The channel in the twin for the exit signal of the task.
+	quit chan struct{}  // The channel closed by turning to offline or tripping, which wakes the pushing blocked by the full channel.
+	swg  sync.WaitGroup // The pushing operations into the channels, waited by turning to offline.
 
-	mu     sync.RWMutex
-	online bool      // The flag about the activity of the peer-node twin, if true means that can work, otherwise cannot.
-	scTime time.Time // The change time of the online/offline status.
+	tmu     sync.Mutex // The lock for turning to online or offline, which serializes the starting and the exit of the task.
+	mu      sync.RWMutex
+	online  bool      // The flag about the activity of the peer-node twin, if true means that can work, otherwise cannot.
+	tripped bool      // The flag about the circuit breaker, if true means that offline but the task keeps probing the provider.
+	scTime  time.Time // The change time of the online/offline status.
 
 	pushSucNum   uint32 // The counter for the pushing operation while online.
 	pushErrNum   uint32 // The counter for the pushing operation while offline.
@@ -25,12 +44,43 @@ type twin struct {
 	transErrNum  uint32 // the error count of the transmitting data operation
 	transSucSize uint64 // the success count of the transmitting data operation
 	transErrSize uint64 // the error count of the transmitting data operation
+
+	msb *tokenBucket // The message-rate shaper, nil means unlimited.
+	bsb *tokenBucket // The bandwidth shaper, nil means unlimited.
+
+	bp      BatchPusher   // The batch pusher, nil means pushing the data one by one.
+	bpNum   int           // The max number of the data in one batch.
+	bpSize  int           // The max bytes of one batch, zero means unlimited.
+	bpDelay time.Duration // The max waiting duration of one batch, zero means no waiting.
+
+	rp  *RetryPolicy      // The retry policy of the failed pushing operation, nil means no retry.
+	dlh DeadLetterHandler // The handler for the data that cannot be delivered, nil means discarding.
+
+	cbFails     uint32        // The consecutive failed pushing attempts, reset by the successful one.
+	cbThreshold uint32        // The consecutive failures to trip the circuit breaker, zero means disabled.
+	cbInterval  time.Duration // The interval of probing the provider while the circuit breaker is tripped.
+
+	ovp OverflowPolicy // The policy for the pushing operation while the channel is full.
+
+	evb *twinEventBus // The bus for the lifecycle events, nil means no event.
+
+	hbRun     uint32 // The flag of the running heartbeat, the ticks are skipped until it finishes.
+	hbMiss    uint32 // The consecutive missed heartbeats.
+	unhealthy bool   // The flag about the heartbeat, if true means turned to offline by the missed heartbeats.
+
+	ses *session // The session of the peer-node, nil means no session.
+	tnt *tenant  // The tenant of the peer-node, nil means no namespace.
+
+	qSize int64      // The bytes of the data waiting in the channels.
+	qMax  int64      // The max bytes queued by the twin, zero means unlimited.
+	qm    *byteMeter // The meter of the bytes queued by all the twins of the pool, nil means unlimited.
 }
 
 func newTwin(provider *TwinServiceProvider) *twin {
 	tw := &twin{
 		prd:          provider,
 		tc:           make(chan []byte, defaultTwinChannelSize),
+		htc:          make(chan []byte, defaultTwinChannelSize),
 		exit:         make(chan struct{}, 0),
 		mu:           sync.RWMutex{},
 		online:       false,
@@ -42,6 +92,7 @@ func newTwin(provider *TwinServiceProvider) *twin {
 		transErrSize: uint64(0),
 	}
 
+	tw.extend()
 	tw.turnToOnline()
 
 	return tw
@@ -54,50 +105,272 @@ func (t *twin) onlineStatus() bool {
 	return t.online
 }
 
+// Return true if the task is running, either online or probing with the tripped circuit breaker.
+func (t *twin) runningStatus() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.online || t.tripped
+}
+
+func (t *twin) unhealthyStatus() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.unhealthy
+}
+
+// Return the number of the data waiting in the channels.
+func (t *twin) queueDepth() int {
+	return len(t.tc) + len(t.htc)
+}
+
+// Return the bytes of the data waiting in the channels and queued in the session.
+func (t *twin) queuedBytes() int64 {
+	size := atomic.LoadInt64(&t.qSize)
+	if ses := t.session(); ses != nil {
+		size += ses.queuedBytes()
+	}
+	return size
+}
+
+func (t *twin) setQueueQuota(max int64, qm *byteMeter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.qMax = max
+	t.qm = qm
+}
+
+func (t *twin) meter() *byteMeter {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.qm
+}
+
+// Reserve the bytes of the data under the queue quotas, return the *QuotaError if exceeded.
+func (t *twin) reserve(size int64) error {
+	t.mu.RLock()
+	qMax, qm := t.qMax, t.qm
+	t.mu.RUnlock()
+
+	if qMax > 0 && t.queuedBytes()+size > qMax {
+		return &QuotaError{Quota: "queued bytes per twin", Limit: qMax}
+	}
+	if !qm.reserve(size) {
+		return &QuotaError{Quota: "queued bytes", Limit: qm.limit()}
+	}
+	return nil
+}
+
+// Release the bytes of the data received from the channels.
+func (t *twin) received(data []byte) []byte {
+	atomic.AddInt64(&t.qSize, -int64(len(data)))
+	t.meter().release(int64(len(data)))
+	return data
+}
+
 func (t *twin) pushMessagePacketToChannel(pkt []byte) error {
-	if !t.onlineStatus() {
-		//todo : building a global cache for all the twins while they offline until expire.
+	return t.pushMessagePacketWithPriority(pkt, PriorityLow)
+}
 
-		kadId := (*t.prd).KadID()
+func (t *twin) pushMessagePacketWithPriority(pkt []byte, priority Priority) error {
+	size := int64(len(pkt))
+	if err := t.reserve(size); err != nil {
 		atomic.AddUint32(&t.pushErrNum, uint32(1))
-		return fmt.Errorf("the '%s:%d' host's twin is not online", kadId.Host.String(), kadId.Port)
+		return err
 	}
 
-	t.tc <- pkt
-	atomic.AddUint32(&t.pushSucNum, uint32(1))
-	return nil
+	// The channels are never closed, and the turning to offline waits for the pushing which has seen the twin online.
+	t.mu.RLock()
+	online, ch, quit := t.online, t.tc, t.quit
+	if priority == PriorityHigh {
+		ch = t.htc
+	}
+	if online {
+		t.swg.Add(1)
+	}
+	t.mu.RUnlock()
+
+	if !online {
+		return t.pushOffline(pkt, priority)
+	}
+	defer t.swg.Done()
+
+	atomic.AddInt64(&t.qSize, size)
+	select {
+	case ch <- pkt:
+		atomic.AddUint32(&t.pushSucNum, uint32(1))
+		return nil
+	default:
+	}
+
+	t.emit(TwinOverflow)
+	return t.overflow(ch, quit, pkt, priority)
 }
 
-func (t *twin) turnToOffline() {
-	if t.onlineStatus() {
-		t.exit <- struct{}{}
+// Push the data into the full channel under the overflow policy, the bytes of the data have been counted.
+func (t *twin) overflow(ch chan []byte, quit chan struct{}, pkt []byte, priority Priority) error {
+	size := int64(len(pkt))
 
-		t.mu.Lock()
-		defer t.mu.Unlock()
+	t.mu.RLock()
+	ovp := t.ovp
+	t.mu.RUnlock()
+
+	switch ovp {
+	case OverflowDropOldest:
+		for {
+			select {
+			case ch <- pkt:
+				atomic.AddUint32(&t.pushSucNum, uint32(1))
+				return nil
+			default:
+			}
+			select {
+			case data := <-ch:
+				t.fail([][]byte{t.received(data)}, DeadLetterOverflow, ErrTwinOverflow)
+			default:
+			}
+		}
+	case OverflowDropNewest, OverflowSpill:
+		atomic.AddInt64(&t.qSize, -size)
+		if ses := t.session(); ovp == OverflowSpill && ses != nil && ses.enqueue(pkt, priority) {
+			atomic.AddUint32(&t.pushSucNum, uint32(1))
+			return nil
+		}
+		t.meter().release(size)
+		atomic.AddUint32(&t.pushErrNum, uint32(1))
+		return ErrTwinOverflow
+	default:
+		select {
+		case ch <- pkt:
+			atomic.AddUint32(&t.pushSucNum, uint32(1))
+			return nil
+		case <-quit:
+			atomic.AddInt64(&t.qSize, -size)
+			return t.pushOffline(pkt, priority)
+		}
+	}
+}
+
+// The persistent session queues the data until the twin turns to online again, otherwise return the error.
+// The bytes of the data have been reserved.
+func (t *twin) pushOffline(pkt []byte, priority Priority) error {
+	if ses := t.session(); ses != nil && ses.enqueue(pkt, priority) {
+		atomic.AddUint32(&t.pushSucNum, uint32(1))
+		return nil
+	}
+	t.meter().release(int64(len(pkt)))
+	atomic.AddUint32(&t.pushErrNum, uint32(1))
+
+	prd := t.provider()
+	if prd == nil {
+		return fmt.Errorf("the twin has been released")
+	}
+	kadId := (*prd).KadID()
+	return fmt.Errorf("the '%s:%d' host's twin is not online", kadId.Host.String(), kadId.Port)
+}
+
+// Return the provider, nil if the twin has been released.
+func (t *twin) provider() *TwinServiceProvider {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.prd
+}
+
+// Safe to be called concurrently, only the caller switching the state signals the exit to the task.
+func (t *twin) turnToOffline() {
+	t.tmu.Lock()
+	defer t.tmu.Unlock()
 
-		t.online = false
+	t.mu.Lock()
+	if !t.online && !t.tripped {
+		t.mu.Unlock()
+		return
+	}
+	online := t.online
+	if online {
 		t.scTime = time.Now()
 	}
+	t.online = false
+	t.tripped = false
+	if online {
+		// The quit channel of the tripped twin has been closed by the tripping.
+		close(t.quit)
+	}
+	t.mu.Unlock()
+
+	// The task always receives the exit signal, which is the only way for it to exit.
+	t.exit <- struct{}{}
+	t.swg.Wait()
+	if online {
+		t.emit(TwinOffline)
+	}
 }
 
+// The twin with the tripped circuit breaker would turn to online only by the successful probing.
 func (t *twin) turnToOnline() {
-	if !t.onlineStatus() {
-		t.mu.Lock()
-		defer t.mu.Unlock()
+	t.tmu.Lock()
+	defer t.tmu.Unlock()
 
-		t.executeTask()
-		t.online = true
-		t.scTime = time.Now()
+	t.mu.Lock()
+	if t.online || t.tripped {
+		t.mu.Unlock()
+		return
+	}
+	t.quit = make(chan struct{})
+	t.executeTask()
+	t.online = true
+	t.scTime = time.Now()
+	t.mu.Unlock()
+
+	t.emit(TwinOnline)
+}
+
+// Turn to online again for the provider, unless turned to offline by the missed heartbeats.
+func (t *twin) resume() {
+	if !t.onlineStatus() && !t.unhealthyStatus() {
+		t.turnToOnline()
+	}
+}
+
+// Bind the twin to the provider of the reconnected peer-node, the running task is restarted for the new one,
+// and the missed heartbeats of the old one are forgotten.
+func (t *twin) rebind(provider *TwinServiceProvider) {
+	if sameProvider(t.provider(), provider) {
+		return
+	}
+	running := t.runningStatus()
+	if running {
+		t.turnToOffline()
+	}
+
+	t.mu.Lock()
+	t.prd = provider
+	t.unhealthy = false
+	t.mu.Unlock()
+	atomic.StoreUint32(&t.hbMiss, 0)
+	t.extend()
+
+	if running {
+		t.turnToOnline()
 	}
 }
 
 func (t *twin) reset() {
 	t.turnToOffline()
 
+	// The data remaining in the channels goes to the session or the dead-letter handler, so that the recycled twin starts empty.
+	t.stash()
+
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	close(t.tc)
+	t.qm.release(atomic.SwapInt64(&t.qSize, 0))
+	t.qm = nil
+	t.qMax = 0
 	t.prd = nil
 	t.pushSucNum = 0
 	t.pushErrNum = 0
@@ -105,44 +378,544 @@ func (t *twin) reset() {
 	t.transErrNum = 0
 	t.transSucSize = 0
 	t.transErrSize = 0
+	t.cbFails = 0
+	t.ovp = OverflowBlock
+	t.hbMiss = 0
+	t.unhealthy = false
+	t.msb = nil
+	t.bsb = nil
+	t.bp = nil
+	t.rp = nil
+	t.dlh = nil
+	t.evb = nil
+	t.ses = nil
+	t.tnt = nil
 }
 
 func (t *twin) initWithOnline(provider *TwinServiceProvider) {
 	t.mu.Lock()
-	t.tc = make(chan []byte, defaultTwinChannelSize)
 	t.prd = provider
 	t.mu.Unlock()
 
+	t.extend()
 	t.turnToOnline()
 }
 
+// Bind the optional extensions of the provider, the burst of the shapers allows one second of traffic.
+func (t *twin) extend() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.msb, t.bsb, t.bp, t.rp = nil, nil, nil, nil
+	if ds, ok := (*t.prd).(DeliveryShaper); ok {
+		msgRate, byteRate := ds.DeliveryRate()
+		if msgRate > 0 {
+			t.msb = newTokenBucket(msgRate, int(msgRate))
+		}
+		if byteRate > 0 {
+			t.bsb = newTokenBucket(byteRate, int(byteRate))
+		}
+	}
+	if bp, ok := (*t.prd).(BatchPusher); ok {
+		t.bp = bp
+		t.bpNum, t.bpSize, t.bpDelay = bp.BatchPolicy()
+		if t.bpNum < 1 {
+			t.bpNum = defaultTwinChannelSize
+		}
+	}
+	if rt, ok := (*t.prd).(Retrier); ok {
+		rp := rt.RetryPolicy()
+		t.rp = &rp
+	}
+}
+
+// The non-positive interval means the default one.
+func (t *twin) setCircuitBreaker(threshold uint32, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultCircuitBreakerInterval
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.cbThreshold = threshold
+	t.cbInterval = interval
+}
+
+func (t *twin) setOverflowPolicy(ovp OverflowPolicy) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ovp = ovp
+}
+
+// Return true if the consecutive failed pushing attempts have reached the threshold.
+func (t *twin) overThreshold() bool {
+	t.mu.RLock()
+	threshold := t.cbThreshold
+	t.mu.RUnlock()
+
+	return threshold > 0 && atomic.LoadUint32(&t.cbFails) >= threshold
+}
+
+// Return false if the last heartbeat is still running, otherwise mark the heartbeat as running.
+func (t *twin) startHeartbeat() bool {
+	return atomic.CompareAndSwapUint32(&t.hbRun, 0, 1)
+}
+
+func (t *twin) finishHeartbeat() {
+	atomic.StoreUint32(&t.hbRun, 0)
+}
+
+// Ping the provider if it implements the Pinger, turn to offline after the max missed heartbeats,
+// and turn to online again after the successful heartbeat if the provider is still paired.
+func (t *twin) heartbeat(maxMissed uint32, paired func() bool) {
+	t.mu.RLock()
+	prd := t.prd
+	t.mu.RUnlock()
+
+	if prd == nil {
+		return
+	}
+	pg, ok := (*prd).(Pinger)
+	if !ok {
+		return
+	}
+
+	if pg.Ping() != nil {
+		if atomic.AddUint32(&t.hbMiss, uint32(1)) >= maxMissed && t.runningStatus() {
+			t.mu.Lock()
+			t.unhealthy = true
+			t.mu.Unlock()
+			t.turnToOffline()
+		}
+		return
+	}
+
+	atomic.StoreUint32(&t.hbMiss, 0)
+	if t.unhealthyStatus() && paired() {
+		t.mu.Lock()
+		t.unhealthy = false
+		t.mu.Unlock()
+		t.turnToOnline()
+	}
+}
+
+// Ping the provider if it implements the Pinger, otherwise regarded as alive.
+func (t *twin) ping() error {
+	if pg, ok := (*t.prd).(Pinger); ok {
+		return pg.Ping()
+	}
+	return nil
+}
+
+// Trip the circuit breaker, the twin turns to offline while the task keeps probing the provider.
+// The pushing blocked by the full channel falls back to the session or fails, since the probing never drains it.
+// The twin having turned to offline is not tripped, and the task would receive the exit signal soon.
+func (t *twin) trip() {
+	t.mu.Lock()
+	if !t.online {
+		t.mu.Unlock()
+		return
+	}
+	t.online = false
+	t.tripped = true
+	t.scTime = time.Now()
+	close(t.quit)
+	t.mu.Unlock()
+
+	t.emit(TwinOffline)
+}
+
+// Reset the circuit breaker after the successful probing, the twin turns to online.
+// The twin having turned to offline while probing stays offline.
+func (t *twin) recover() {
+	t.mu.Lock()
+	if !t.tripped {
+		t.mu.Unlock()
+		return
+	}
+	t.online = true
+	t.tripped = false
+	t.scTime = time.Now()
+	t.quit = make(chan struct{})
+	t.mu.Unlock()
+
+	t.emit(TwinOnline)
+}
+
+func (t *twin) setEventBus(evb *twinEventBus) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.evb = evb
+}
+
+func (t *twin) emit(et TwinEventType) {
+	t.mu.RLock()
+	evb, prd := t.evb, t.prd
+	t.mu.RUnlock()
+
+	if evb != nil && prd != nil {
+		evb.emit(et, (*prd).KadID())
+	}
+}
+
+func (t *twin) setTenant(tn *tenant) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.tnt = tn
+}
+
+func (t *twin) tenant() *tenant {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.tnt
+}
+
+func (t *twin) setSession(ses *session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ses = ses
+}
+
+func (t *twin) session() *session {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.ses
+}
+
+// Return the subscription options matching the topic from the session.
+func (t *twin) subscriptionFor(topic []byte) (Subscription, bool) {
+	if ses := t.session(); ses != nil {
+		return ses.subscriptionFor(topic)
+	}
+	return Subscription{}, false
+}
+
+// Move the data remaining in the channels into the persistent session after the task exits, the high-priority data first.
+// Without the persistent session, the data is passed to the dead-letter handler instead of being discarded.
+func (t *twin) stash() {
+	ses := t.session()
+	if ses != nil && ses.isClean() {
+		ses = nil
+	}
+	for _, ch := range []chan []byte{t.htc, t.tc} {
+		priority := PriorityLow
+		if ch == t.htc {
+			priority = PriorityHigh
+		}
+		for len(ch) > 0 {
+			data := <-ch
+			atomic.AddInt64(&t.qSize, -int64(len(data)))
+			if ses == nil {
+				t.meter().release(int64(len(data)))
+				t.fail([][]byte{data}, DeadLetterTwinOffline, fmt.Errorf("the twin has been released"))
+			} else if !ses.enqueue(data, priority) {
+				t.meter().release(int64(len(data)))
+				t.fail([][]byte{data}, DeadLetterTwinOffline, fmt.Errorf("the session queue is full"))
+			}
+		}
+	}
+}
+
+func (t *twin) setDeadLetterHandler(handler DeadLetterHandler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.dlh = handler
+}
+
+func (t *twin) deadLetter(reason DeadLetterReason, err error, data []byte) {
+	t.mu.RLock()
+	handler, prd := t.dlh, t.prd
+	t.mu.RUnlock()
+
+	if handler != nil && prd != nil {
+		handler(newDeadLetter(reason, err, (*prd).KadID(), data))
+	}
+}
+
+// Sleep for the duration, return false if the exit signal has been received.
+func (t *twin) sleep(d time.Duration) bool {
+	if d <= 0 {
+		select {
+		case <-t.exit:
+			return false
+		default:
+			return true
+		}
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-t.exit:
+		return false
+	}
+}
+
+// Wait until the shapers allow the data to be pushed, return false if the exit signal has been received.
+func (t *twin) pace(num int, size int) bool {
+	var delay time.Duration
+	if t.msb != nil {
+		delay = t.msb.reserve(float64(num))
+	}
+	if t.bsb != nil {
+		if d := t.bsb.reserve(float64(size)); d > delay {
+			delay = d
+		}
+	}
+	return t.sleep(delay)
+}
+
 func (t *twin) executeTask() {
 	go func() {
+		var held []byte // The data held back by the last batch for the max bytes.
 		for {
-			select {
-			case data, ok := <-t.tc:
-				if ok {
-					size := len(data)
-					err := (*t.prd).Push(data)
-					if err != nil {
-						atomic.AddUint32(&t.transErrNum, uint32(1))
-						atomic.AddUint64(&t.transErrSize, uint64(size))
-					} else {
-						atomic.AddUint32(&t.transSucNum, uint32(1))
-						atomic.AddUint64(&t.transSucSize, uint64(size))
-					}
+			var data []byte
+			if held != nil {
+				data, held = held, nil
+			} else {
+				var exit bool
+				if data, _, exit = t.receive(nil); exit {
+					return
+				}
+			}
+
+			batch := [][]byte{data}
+			var exit bool
+			if t.bp != nil {
+				batch, held, exit = t.collect(batch)
+			}
+			if exit || !t.transmit(batch) {
+				if held != nil {
+					t.fail([][]byte{held}, DeadLetterTwinOffline, fmt.Errorf("the twin turns to offline"))
 				}
-			case <-t.exit:
 				return
 			}
 		}
 	}()
 }
 
-func (t *twin) close() {
-	if t.onlineStatus() {
-		t.exit <- struct{}{}
+// Receive the data, the high-priority data overtakes the low-priority data.
+// Return whether the data has been received before the timeout, and whether the exit signal has been received.
+func (t *twin) receive(timeout <-chan time.Time) ([]byte, bool, bool) {
+	if data, ok := t.unqueue(); ok {
+		return data, true, false
+	}
+	for {
+		select {
+		case data, ok := <-t.htc:
+			if ok {
+				return t.received(data), true, false
+			}
+		default:
+		}
+
+		select {
+		case data, ok := <-t.htc:
+			if ok {
+				return t.received(data), true, false
+			}
+		case data, ok := <-t.tc:
+			if ok {
+				return t.received(data), true, false
+			}
+		case <-timeout:
+			return nil, false, false
+		case <-t.exit:
+			return nil, false, true
+		}
+	}
+}
+
+// Dequeue the data queued in the session while the twin was offline.
+func (t *twin) unqueue() ([]byte, bool) {
+	if ses := t.session(); ses != nil {
+		if data, ok := ses.dequeue(); ok {
+			t.meter().release(int64(len(data)))
+			return data, true
+		}
+	}
+	return nil, false
+}
+
+// Receive the data without blocking, the high-priority data overtakes the low-priority data.
+func (t *twin) tryReceive() ([]byte, bool) {
+	if data, ok := t.unqueue(); ok {
+		return data, true
+	}
+	select {
+	case data, ok := <-t.htc:
+		if ok {
+			return t.received(data), true
+		}
+	default:
+	}
+
+	select {
+	case data, ok := <-t.tc:
+		if ok {
+			return t.received(data), true
+		}
+	default:
+	}
+	return nil, false
+}
+
+// Gather the data into one batch until the max number, the max bytes or the max waiting duration is reached.
+// Return the data held back for the next batch, which would exceed the max bytes, and only the first data of
+// the batch may exceed it alone. Return true if the exit signal has been received, and the batch would be
+// counted as failure.
+func (t *twin) collect(batch [][]byte) ([][]byte, []byte, bool) {
+	size := len(batch[0])
+
+	var timeout <-chan time.Time
+	if t.bpDelay > 0 {
+		timer := time.NewTimer(t.bpDelay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for len(batch) < t.bpNum && (t.bpSize <= 0 || size < t.bpSize) {
+		var data []byte
+		var received, exit bool
+		if timeout != nil {
+			data, received, exit = t.receive(timeout)
+		} else {
+			// Only gather the data that is already in the channels.
+			data, received = t.tryReceive()
+		}
+		if exit {
+			t.fail(batch, DeadLetterTwinOffline, fmt.Errorf("the twin turns to offline"))
+			return batch, nil, true
+		}
+		if !received {
+			break
+		}
+		if t.bpSize > 0 && size+len(data) > t.bpSize {
+			return batch, data, false
+		}
+		batch = append(batch, data)
+		size += len(data)
+	}
+	return batch, nil, false
+}
+
+// Return false if the exit signal has been received while pacing.
+func (t *twin) transmit(batch [][]byte) bool {
+	size := 0
+	for i := range batch {
+		size += len(batch[i])
+	}
+	if !t.pace(len(batch), size) {
+		t.fail(batch, DeadLetterTwinOffline, fmt.Errorf("the twin turns to offline"))
+		return false
+	}
+
+	if t.bp != nil {
+		exit, err := t.deliver(func() error { return t.bp.PushBatch(batch) })
+		t.count(batch, err)
+		return !exit
+	}
+
+	for i := range batch {
+		data := batch[i]
+		exit, err := t.deliver(func() error { return (*t.prd).Push(data) })
+		t.count(batch[i:i+1], err)
+		if exit {
+			t.fail(batch[i+1:], DeadLetterTwinOffline, fmt.Errorf("the twin turns to offline"))
+			return false
+		}
+	}
+	return true
+}
+
+// Push with the retry policy, trip the circuit breaker if the failure reaches the threshold,
+// and then probe the provider with the ping and the same data until it recovers or the exit signal has been received.
+func (t *twin) deliver(push func() error) (bool, error) {
+	push = t.counted(push)
+	exit, err := t.retry(push)
+	if exit || err == nil || !t.overThreshold() {
+		return exit, err
+	}
+
+	t.trip()
+	for {
+		t.mu.RLock()
+		interval := t.cbInterval
+		t.mu.RUnlock()
+
+		if !t.sleep(interval) {
+			return true, err
+		}
+		if t.ping() != nil {
+			continue
+		}
+		if err = push(); err == nil {
+			t.recover()
+			return false, nil
+		}
+	}
+}
+
+// Count the consecutive failed pushing attempts for the circuit breaker.
+func (t *twin) counted(push func() error) func() error {
+	return func() error {
+		err := push()
+		if err != nil {
+			atomic.AddUint32(&t.cbFails, uint32(1))
+		} else {
+			atomic.StoreUint32(&t.cbFails, 0)
+		}
+		return err
+	}
+}
+
+// Push with the retry policy, return whether the exit signal has been received while backoff, and the last error.
+func (t *twin) retry(push func() error) (bool, error) {
+	err := push()
+	if t.rp == nil {
+		return false, err
 	}
-	close(t.tc)
+
+	for attempt := 1; t.rp.retryable(attempt, err); attempt++ {
+		if !t.sleep(t.rp.backoff(attempt)) {
+			return true, err
+		}
+		err = push()
+	}
+	return false, err
+}
+
+func (t *twin) count(batch [][]byte, err error) {
+	if err != nil {
+		t.fail(batch, DeadLetterPushFailed, err)
+		return
+	}
+	for i := range batch {
+		atomic.AddUint32(&t.transSucNum, uint32(1))
+		atomic.AddUint64(&t.transSucSize, uint64(len(batch[i])))
+	}
+}
+
+func (t *twin) fail(batch [][]byte, reason DeadLetterReason, err error) {
+	for i := range batch {
+		atomic.AddUint32(&t.transErrNum, uint32(1))
+		atomic.AddUint64(&t.transErrSize, uint64(len(batch[i])))
+		t.deadLetter(reason, err, batch[i])
+	}
+}
+
+func (t *twin) close() {
+	t.turnToOffline()
 	close(t.exit)
 }
@@ -0,0 +1,123 @@
+package marina
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lithdew/kademlia"
+)
+
+const defaultTwinEventChannelSize = 64 // The default channel size for the twin event observer.
+
+type TwinEventType byte
+
+const (
+	TwinCreated  TwinEventType = iota + 1 // The twin is created or reused for the provider.
+	TwinOnline                            // The twin turns to online.
+	TwinOffline                           // The twin turns to offline.
+	TwinReleased                          // The twin is reset and released into the pool.
+	TwinOverflow                          // The channel of the twin is full, the pushing operation follows the overflow policy.
+)
+
+func (et TwinEventType) String() string {
+	switch et {
+	case TwinCreated:
+		return "created"
+	case TwinOnline:
+		return "online"
+	case TwinOffline:
+		return "offline"
+	case TwinReleased:
+		return "released"
+	case TwinOverflow:
+		return "overflow"
+	default:
+		return "unknown"
+	}
+}
+
+type TwinEvent struct {
+	Type  TwinEventType
+	KadID *kademlia.ID
+	Time  time.Time
+}
+
+// The observer receives the events from the channel, the events would be dropped while the channel is full.
+type TwinObserver struct {
+	ch      chan TwinEvent
+	dropNum uint32 // the count of the dropped events while the channel is full
+	once    sync.Once
+	cancel  func()
+}
+
+func (ob *TwinObserver) Events() <-chan TwinEvent {
+	return ob.ch
+}
+
+func (ob *TwinObserver) DroppedNum() uint32 {
+	return atomic.LoadUint32(&ob.dropNum)
+}
+
+// Stop observing and close the events channel.
+func (ob *TwinObserver) Close() {
+	ob.once.Do(ob.cancel)
+}
+
+// The event bus delivers the events to all of the observers without blocking.
+type twinEventBus struct {
+	mu  sync.RWMutex
+	id  int
+	obs map[int]*TwinObserver
+}
+
+func newTwinEventBus() *twinEventBus {
+	return &twinEventBus{
+		mu:  sync.RWMutex{},
+		id:  0,
+		obs: make(map[int]*TwinObserver),
+	}
+}
+
+func (eb *twinEventBus) observe(size int) *TwinObserver {
+	if size < 1 {
+		size = defaultTwinEventChannelSize
+	}
+	ob := &TwinObserver{ch: make(chan TwinEvent, size)}
+
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+
+	eb.id++
+	id := eb.id
+	eb.obs[id] = ob
+	ob.cancel = func() {
+		eb.mu.Lock()
+		defer eb.mu.Unlock()
+
+		delete(eb.obs, id)
+		close(ob.ch)
+	}
+	return ob
+}
+
+func (eb *twinEventBus) emit(et TwinEventType, kadId *kademlia.ID) {
+	if eb == nil {
+		return
+	}
+
+	eb.mu.RLock()
+	defer eb.mu.RUnlock()
+
+	if len(eb.obs) == 0 {
+		return
+	}
+	ev := TwinEvent{Type: et, KadID: kadId, Time: time.Now()}
+	for _, ob := range eb.obs {
+		select {
+		case ob.ch <- ev:
+		default:
+			atomic.AddUint32(&ob.dropNum, uint32(1))
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package marina
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func nextTwinEvent(t *testing.T, ob *TwinObserver) TwinEvent {
+	select {
+	case ev := <-ob.Events():
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("no twin event")
+	}
+	return TwinEvent{}
+}
+
+func TestTwinEvent(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	require.Equal(t, "created", TwinCreated.String())
+	require.Equal(t, "online", TwinOnline.String())
+	require.Equal(t, "offline", TwinOffline.String())
+	require.Equal(t, "released", TwinReleased.String())
+	require.Equal(t, "overflow", TwinOverflow.String())
+	require.Equal(t, "unknown", TwinEventType(0).String())
+
+	tp := NewTwinsPool()
+	defer tp.Close()
+
+	ob := tp.Observe(0)
+	defer ob.Close()
+
+	kid, err := generateKadId()
+	require.NoError(t, err)
+
+	gp := &gatedProvider{kadId: kid, gate: make(chan struct{})}
+	var prd TwinServiceProvider = gp
+	tw := tp.acquire(&prd)
+
+	ev := nextTwinEvent(t, ob)
+	require.Equal(t, TwinCreated, ev.Type)
+	require.Equal(t, kid, ev.KadID)
+	require.Equal(t, false, ev.Time.IsZero())
+
+	// overflow
+	require.NoError(t, tw.pushMessagePacketToChannel([]byte("hello")))
+	require.Eventually(t, func() bool { return len(gp.received()) == 1 }, time.Second, time.Millisecond)
+	for i := 0; i < defaultTwinChannelSize; i++ {
+		require.NoError(t, tw.pushMessagePacketToChannel([]byte("hello")))
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = tw.pushMessagePacketToChannel([]byte("hello"))
+	}()
+	require.Equal(t, TwinOverflow, nextTwinEvent(t, ob).Type)
+	close(gp.gate)
+	<-done
+
+	tw.turnToOffline()
+	require.Equal(t, TwinOffline, nextTwinEvent(t, ob).Type)
+	tw.turnToOnline()
+	require.Equal(t, TwinOnline, nextTwinEvent(t, ob).Type)
+
+	tp.release(tw)
+	require.Equal(t, TwinOffline, nextTwinEvent(t, ob).Type)
+	ev = nextTwinEvent(t, ob)
+	require.Equal(t, TwinReleased, ev.Type)
+	require.Equal(t, kid, ev.KadID)
+
+	// dropped while the channel is full, without blocking
+	ob2 := tp.Observe(1)
+	tw = tp.acquire(&prd)
+	tw.turnToOffline()
+	require.Equal(t, uint32(1), ob2.DroppedNum())
+	require.Equal(t, TwinCreated, nextTwinEvent(t, ob2).Type)
+
+	ob2.Close()
+	ob2.Close()
+	_, ok := <-ob2.Events()
+	require.Equal(t, false, ok)
+	require.Equal(t, TwinCreated, nextTwinEvent(t, ob).Type)
+	require.Equal(t, TwinOffline, nextTwinEvent(t, ob).Type)
+}
@@ -1,9 +1,54 @@
 package marina
 
-import "github.com/lithdew/kademlia"
+import (
+	"reflect"
+	"time"
+
+	"github.com/lithdew/kademlia"
+)
 
 // The remote service provider for the twin.
 type TwinServiceProvider interface {
 	KadID() *kademlia.ID
 	Push(data []byte) error
 }
+
+// Return true if both point to the same provider, the providers of the uncomparable types are never the same.
+func sameProvider(a, b *TwinServiceProvider) bool {
+	if a == b {
+		return true
+	}
+	if a == nil || b == nil || *a == nil || *b == nil {
+		return false
+	}
+	ta := reflect.TypeOf(*a)
+	return ta == reflect.TypeOf(*b) && ta.Comparable() && *a == *b
+}
+
+// The optional extension of the remote service provider, the twin would pace the pushing operations by the rate.
+type DeliveryShaper interface {
+	// Return the message-packets per second and the bytes per second, the zero value means unlimited.
+	DeliveryRate() (msgRate float64, byteRate float64)
+}
+
+// The optional extension of the remote service provider, the twin would coalesce the data into one pushing operation.
+type BatchPusher interface {
+	// Return the max number of the data, the max bytes, and the max waiting duration of one batch.
+	BatchPolicy() (maxNum int, maxSize int, maxDelay time.Duration)
+	PushBatch(batch [][]byte) error
+}
+
+// The optional extension of the remote service provider, the twin would retry the failed pushing operations.
+type Retrier interface {
+	RetryPolicy() RetryPolicy
+}
+
+// The optional extension of the remote service provider, for the heartbeat of the twins pool.
+type Pinger interface {
+	Ping() error
+}
+
+// The optional extension of the remote service provider, which receives the acknowledgements of its subscriptions.
+type AckReceiver interface {
+	ReceiveAck(ack *Ack)
+}
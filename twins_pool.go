@@ -1,6 +1,8 @@
 package marina
 
 import (
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -11,15 +13,39 @@ const defaultMaxTwinWorkers = 32
 const defaultMaxTwinOfflineTimeDuration = 5 * time.Minute
 
 type TwinsPool struct {
-	mu sync.RWMutex
-	sp sync.Pool
+	mu  sync.RWMutex
+	smu sync.Mutex // The lock for linking and unlinking the twins in the topic tree.
+	sp  sync.Pool
 
 	ttp *taskPool
 	// One remote service provider paired with one twin which own the same KadID.
 	mpt map[kademlia.PublicKey]*twin
 	mpp map[kademlia.PublicKey]*TwinServiceProvider
+	// The sessions of the peer-nodes, which record the subscriptions and survive the releasing of the twins.
+	mps map[kademlia.PublicKey]*session
+	// The shared subscription groups keyed by the '$share/group/filter' topic, and the strategies keyed by the group.
+	mpg map[string]*shareGroup
+	mss map[string]ShareStrategy
+
+	tt  TopicIndex // The topic index for linking the twins, bound by the subscribe worker.
+	tns *Tenants   // The tenants of the peer-nodes, nil means no namespace.
+
+	qs Quotas     // The quotas of the pool.
+	qm *byteMeter // The meter of the bytes queued by all the twins.
 
 	maxOfflineTimeDuration time.Duration
+
+	dlh DeadLetterHandler // The handler for the data that the twins cannot deliver.
+
+	cbThreshold uint32        // The consecutive failures to trip the circuit breaker of the twin, zero means disabled.
+	cbInterval  time.Duration // The interval of probing the provider while the circuit breaker is tripped.
+
+	ovp OverflowPolicy // The policy for the pushing operation while the channel of the twin is full.
+
+	hbj *periodicJob // The heartbeat job, nil means disabled.
+	rcj *periodicJob // The reconciling job, nil means disabled.
+
+	evb *twinEventBus // The bus for the lifecycle events of the twins.
 }
 
 func NewTwinsPool() *TwinsPool {
@@ -29,10 +55,118 @@ func NewTwinsPool() *TwinsPool {
 		ttp:                    newTaskPool(defaultMaxTwinWorkers),
 		mpt:                    make(map[kademlia.PublicKey]*twin),
 		mpp:                    make(map[kademlia.PublicKey]*TwinServiceProvider),
+		mps:                    make(map[kademlia.PublicKey]*session),
+		mpg:                    make(map[string]*shareGroup),
+		mss:                    make(map[string]ShareStrategy),
+		qm:                     newByteMeter(),
 		maxOfflineTimeDuration: defaultMaxTwinOfflineTimeDuration,
+		evb:                    newTwinEventBus(),
+	}
+}
+
+// Observe the lifecycle events of the twins, the size is the capacity of the events channel.
+// The delivery never blocks the twins, and the events would be dropped while the channel is full.
+func (tp *TwinsPool) Observe(size int) *TwinObserver {
+	return tp.evb.observe(size)
+}
+
+// Set the handler for the data that the twins cannot deliver, the existing twins would be updated too.
+func (tp *TwinsPool) SetDeadLetterHandler(handler DeadLetterHandler) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	tp.dlh = handler
+	for _, tw := range tp.mpt {
+		tw.setDeadLetterHandler(handler)
+	}
+}
+
+// Set the circuit breaker for every twin, which turns to offline after the consecutive failures of the pushing,
+// and probes the provider at the interval until it recovers. The zero threshold disables the circuit breaker,
+// and the non-positive interval means one second.
+func (tp *TwinsPool) SetCircuitBreaker(threshold uint32, probeInterval time.Duration) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	tp.cbThreshold = threshold
+	tp.cbInterval = probeInterval
+	for _, tw := range tp.mpt {
+		tw.setCircuitBreaker(threshold, probeInterval)
+	}
+}
+
+// Set the overflow policy for every twin, which decides the pushing operation while the channel is full.
+// The default OverflowBlock blocks the publish worker until the channel has room.
+func (tp *TwinsPool) SetOverflowPolicy(ovp OverflowPolicy) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	tp.ovp = ovp
+	for _, tw := range tp.mpt {
+		tw.setOverflowPolicy(ovp)
 	}
 }
 
+// Set the heartbeat for the twins whose paired providers implement the Pinger, the pings run on the pool's task pool.
+// The twin turns to offline after the max missed heartbeats, and turns to online again after the successful one.
+// The zero interval disables the heartbeat.
+func (tp *TwinsPool) SetHeartbeat(interval time.Duration, maxMissed uint32) {
+	if maxMissed < 1 {
+		maxMissed = 1
+	}
+
+	var hbj *periodicJob
+	if interval > 0 {
+		hbj = startPeriodicJob(interval, func() {
+			for _, tw := range tp.twins() {
+				tw := tw
+				paired := func() bool { return tp.paired(tw) }
+				if !paired() {
+					// The twin without the paired provider is left to the reconciling.
+					continue
+				}
+				if !tw.startHeartbeat() {
+					// The last heartbeat of the twin is still running, e.g. waiting for the slow pushing.
+					continue
+				}
+				tp.ttp.submitTask(func() {
+					defer tw.finishHeartbeat()
+					tw.heartbeat(maxMissed, paired)
+				})
+			}
+		})
+	}
+
+	tp.mu.Lock()
+	hbj, tp.hbj = tp.hbj, hbj
+	tp.mu.Unlock()
+
+	// Stopping the previous job outside the lock, which may be waiting for the snapshot of the twins.
+	hbj.stop()
+}
+
+// Return true if the provider of the twin is still paired.
+func (tp *TwinsPool) paired(tw *twin) bool {
+	prd := tw.provider()
+	if prd == nil {
+		return false
+	}
+	_, exist := tp.existServiceProvider((*prd).KadID().Pub)
+	return exist
+}
+
+// Return the snapshot of all the twins.
+func (tp *TwinsPool) twins() []*twin {
+	tp.mu.RLock()
+	defer tp.mu.RUnlock()
+
+	twins := make([]*twin, 0, len(tp.mpt))
+	for _, tw := range tp.mpt {
+		twins = append(twins, tw)
+	}
+	return twins
+}
+
 func (tp *TwinsPool) length() (int, int) {
 	tp.mu.RLock()
 	defer tp.mu.RUnlock()
@@ -40,22 +174,44 @@ func (tp *TwinsPool) length() (int, int) {
 	return len(tp.mpt), len(tp.mpp)
 }
 
-// return the number of the append providers
-func (tp *TwinsPool) appendProviders(providers ...*TwinServiceProvider) int {
+// return the number of the append providers, and the *QuotaError or the ErrTenantQuotaExceeded
+// if some of the providers have been refused, the new provider without the twin would not be appended
+func (tp *TwinsPool) appendProviders(providers ...*TwinServiceProvider) (int, error) {
 	var pNum = 0
+	var qErr error
 	for i := range providers {
 		pubK := (*providers[i]).KadID().Pub
-		_, pExist := tp.existServiceProvider(pubK)
+		tp.mu.Lock()
+		current, pExist := tp.mpp[pubK]
+		if pExist && !sameProvider(current, providers[i]) {
+			// The reconnected peer-node replaces the provider of the old connection.
+			tp.mpp[pubK] = providers[i]
+		}
 		if !pExist {
-			tp.mu.Lock()
+			if max := tp.qs.MaxProviders; max > 0 && len(tp.mpp) >= max {
+				tp.mu.Unlock()
+				qErr = &QuotaError{Quota: "providers", Limit: int64(max)}
+				continue
+			}
 			tp.mpp[pubK] = providers[i]
-			tp.mu.Unlock()
-			pNum++
 		}
+		tp.mu.Unlock()
+
 		// acquire twin
-		_ = tp.acquire(providers[i])
+		if _, err := tp.acquireTwin(providers[i]); err != nil {
+			qErr = err
+			if !pExist {
+				tp.mu.Lock()
+				delete(tp.mpp, pubK)
+				tp.mu.Unlock()
+			}
+			continue
+		}
+		if !pExist {
+			pNum++
+		}
 	}
-	return pNum
+	return pNum, qErr
 }
 
 // return the number of the removed providers, the number of excess-twins,
@@ -74,54 +230,135 @@ func (tp *TwinsPool) removeProviders(providers ...*TwinServiceProvider) (int, in
 		if tExist {
 			// offline or release twin
 			excessTwinNum++
-			if tw.onlineStatus() {
+			if tw.runningStatus() {
 				tw.turnToOffline()
 			} else {
 				// Releasing the twin that has been offline for too long.
 				if time.Since(tw.scTime) > tp.maxOfflineTimeDuration {
 					tp.release(tw)
+					continue
 				}
 			}
+			tp.dropCleanSession(tw, pubK)
 		}
 	}
 	return pNum, excessTwinNum
 }
 
+// The clean session does not survive the disconnecting, its subscriptions are dropped before the twin is released.
+func (tp *TwinsPool) dropCleanSession(tw *twin, pubK kademlia.PublicKey) {
+	tp.mu.RLock()
+	ses := tp.mps[pubK]
+	tp.mu.RUnlock()
+
+	if ses == nil || !ses.isClean() {
+		return
+	}
+	tp.smu.Lock()
+	tp.unlinkAll(tw, pubK)
+	tp.smu.Unlock()
+	tw.setSession(nil)
+}
+
 //return the number of excess-twins, the number of lacking-twins
 func (tp *TwinsPool) checkTwinsProvidersPairStatus() (int, int) {
-	var pNum, excessTwinNum = 0, 0
-	for k, tw := range tp.mpt {
-		tp.mu.RLock()
-		_, exist := tp.mpp[k]
-		tp.mu.RUnlock()
+	rr := tp.reconcile()
+	return rr.ExcessTwinNum, rr.LackingTwinNum
+}
+
+// The report of one round of the reconciling between the twins and the providers.
+type ReconcileReport struct {
+	Time            time.Time
+	ExcessTwinNum   int // The number of the twins without the paired provider.
+	LackingTwinNum  int // The number of the providers without the paired twin.
+	ReleasedTwinNum int // The number of the twins released for being offline too long.
+}
+
+// Pair the providers with the twins, turn the excess twins to offline, and release the ones offline for too long.
+func (tp *TwinsPool) reconcile() ReconcileReport {
+	rr := ReconcileReport{Time: time.Now()}
+
+	tp.mu.RLock()
+	maxOfflineTimeDuration := tp.maxOfflineTimeDuration
+	tp.mu.RUnlock()
 
+	var pNum = 0
+	for _, tw := range tp.twins() {
+		tw.mu.RLock()
+		prd, scTime := tw.prd, tw.scTime
+		tw.mu.RUnlock()
+		if prd == nil {
+			// already released
+			continue
+		}
+
+		_, exist := tp.existServiceProvider((*prd).KadID().Pub)
 		if exist {
 			pNum++
-			if !tw.onlineStatus() {
+			if !tw.onlineStatus() && !tw.unhealthyStatus() {
 				tw.turnToOnline()
 			}
 		} else {
-			excessTwinNum++
-			if tw.onlineStatus() {
+			rr.ExcessTwinNum++
+			if tw.runningStatus() {
 				tw.turnToOffline()
 			} else {
 				// Releasing the twin that has been offline for too long.
-				if time.Since(tw.scTime) > tp.maxOfflineTimeDuration {
+				if time.Since(scTime) > maxOfflineTimeDuration {
 					tp.release(tw)
+					rr.ReleasedTwinNum++
 				}
 			}
 		}
 	}
 
-	lackingTwinNum := len(tp.mpp) - pNum
-	if lackingTwinNum > 0 {
+	tp.mu.RLock()
+	providers := make([]*TwinServiceProvider, 0, len(tp.mpp))
+	for _, pd := range tp.mpp {
+		providers = append(providers, pd)
+	}
+	tp.mu.RUnlock()
+
+	rr.LackingTwinNum = len(providers) - pNum
+	if rr.LackingTwinNum > 0 {
 		//  means some of providers haven't the pair twins.
-		for _, pd := range tp.mpp {
+		for _, pd := range providers {
 			_ = tp.acquire(pd)
 		}
 	}
 
-	return excessTwinNum, lackingTwinNum
+	return rr
+}
+
+// Set the background reconciling on the pool's task pool, which pairs the providers with the twins,
+// and releases the twins offline for too long, then reports to the handler if not nil.
+// The zero interval disables the reconciling.
+func (tp *TwinsPool) SetReconcile(interval time.Duration, handler func(rr ReconcileReport)) {
+	var rcj *periodicJob
+	if interval > 0 {
+		rcj = startPeriodicJob(interval, func() {
+			tp.ttp.submitTask(func() {
+				rr := tp.reconcile()
+				if handler != nil {
+					handler(rr)
+				}
+			})
+		})
+	}
+
+	tp.mu.Lock()
+	rcj, tp.rcj = tp.rcj, rcj
+	tp.mu.Unlock()
+
+	rcj.stop()
+}
+
+// Set the max duration of the twin being offline before released.
+func (tp *TwinsPool) SetMaxOfflineTimeDuration(d time.Duration) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	tp.maxOfflineTimeDuration = d
 }
 
 func (tp *TwinsPool) existServiceProvider(pubK kademlia.PublicKey) (*TwinServiceProvider, bool) {
@@ -141,17 +378,41 @@ func (tp *TwinsPool) existTwin(pubK kademlia.PublicKey) (*twin, bool) {
 }
 
 func (tp *TwinsPool) acquire(provider *TwinServiceProvider) *twin {
+	tw, _ := tp.acquireTwin(provider)
+	return tw
+}
+
+// Return the twin paired with the provider, which is created if not exist.
+// Return the *QuotaError or the ErrTenantQuotaExceeded if there is no room for the new twin.
+func (tp *TwinsPool) acquireTwin(provider *TwinServiceProvider) (*twin, error) {
 	if provider == nil || (*provider).KadID() == nil {
-		return nil
+		return nil, ErrUnknownTwin
 	}
 
 	pubK := (*provider).KadID().Pub
 	tw, exist := tp.existTwin(pubK)
 	if exist {
-		if !tw.onlineStatus() {
-			tw.turnToOnline()
-		}
-		return tw
+		tw.rebind(provider)
+		tw.resume()
+		return tw, nil
+	}
+	tn := tp.tenantOf(pubK)
+
+	// The room is checked and reserved under the same lock as the inserting, so that the quotas cannot be overrun.
+	tp.mu.Lock()
+	if tw, exist = tp.mpt[pubK]; exist {
+		tp.mu.Unlock()
+		tw.rebind(provider)
+		tw.resume()
+		return tw, nil
+	}
+	if err := tp.twinRoom(); err != nil {
+		tp.mu.Unlock()
+		return nil, err
+	}
+	if err := tn.acquireTwin(); err != nil {
+		tp.mu.Unlock()
+		return nil, err
 	}
 
 	v := tp.sp.Get()
@@ -162,20 +423,49 @@ func (tp *TwinsPool) acquire(provider *TwinServiceProvider) *twin {
 	}
 	tw = v.(*twin)
 
-	tp.mu.Lock()
+	tw.setDeadLetterHandler(tp.dlh)
+	tw.setCircuitBreaker(tp.cbThreshold, tp.cbInterval)
+	tw.setOverflowPolicy(tp.ovp)
+	tw.setEventBus(tp.evb)
+	tw.setTenant(tn)
+	tw.setQueueQuota(tp.qs.MaxQueuedBytesPerTwin, tp.qm)
+	ses, tt := tp.mps[pubK], tp.tt
 	tp.mpt[pubK] = tw
 	tp.mu.Unlock()
 
-	return tw
+	if ses != nil {
+		// Restore the links of the persistent session against the new twin, the queued data follows.
+		tp.smu.Lock()
+		if tt != nil {
+			for topic := range ses.subscriptions() {
+				_ = tp.link(tt, tn.topic([]byte(topic)), tw)
+			}
+		}
+		tw.setSession(ses)
+		tp.smu.Unlock()
+	}
+
+	tp.evb.emit(TwinCreated, (*provider).KadID())
+	return tw, nil
 }
 
 func (tp *TwinsPool) release(tw *twin) {
-	if tw == nil || tw.prd == nil || (*tw.prd).KadID() == nil {
+	if tw == nil {
+		return
+	}
+	prd := tw.provider()
+	if prd == nil || (*prd).KadID() == nil {
 		// already reset or kadId pointer equal nil
 		return
 	}
 
-	pubK := (*tw.prd).KadID().Pub
+	kadId := (*prd).KadID()
+	pubK := kadId.Pub
+
+	// Hold the subscription lock, so that the twin cannot be linked again while its links are removing.
+	tp.smu.Lock()
+	defer tp.smu.Unlock()
+
 	tp.mu.RLock()
 	_, exist := tp.mpt[pubK]
 	tp.mu.RUnlock()
@@ -186,11 +476,324 @@ func (tp *TwinsPool) release(tw *twin) {
 		tp.mu.Unlock()
 	}
 
+	tw.turnToOffline()
+	tp.unlinkAll(tw, pubK)
+	tw.tenant().releaseTwin()
 	tw.reset()
 	tp.sp.Put(tw)
+	tp.evb.emit(TwinReleased, kadId)
+}
+
+// Unlink the twin from all the subscribed topics, the recycled twin would not receive the data for the others.
+// The persistent session keeps the subscriptions and the queued data, the clean session is discarded.
+func (tp *TwinsPool) unlinkAll(tw *twin, pubK kademlia.PublicKey) {
+	tp.mu.Lock()
+	ses, tt := tp.mps[pubK], tp.tt
+	if ses != nil && ses.isClean() {
+		delete(tp.mps, pubK)
+	}
+	tp.mu.Unlock()
+
+	if ses == nil {
+		return
+	}
+	tn := tw.tenant()
+	subs := ses.subscriptions()
+	if ses.isClean() {
+		tn.removeSubscriptions(len(subs))
+	} else {
+		tw.stash()
+	}
+	if tt != nil {
+		for topic := range subs {
+			_ = tp.unlink(tt, tn.topic([]byte(topic)), tw)
+		}
+	}
+}
+
+// Return the subscriptions of the peer-node sorted by the topic, which survive the releasing of the twin
+// only if the session is persistent.
+func (tp *TwinsPool) SubscriptionsOf(pubK kademlia.PublicKey) []Subscription {
+	tp.mu.RLock()
+	ses := tp.mps[pubK]
+	tp.mu.RUnlock()
+
+	if ses == nil {
+		return nil
+	}
+	subs := ses.subscriptions()
+	topics := make([]string, 0, len(subs))
+	for topic := range subs {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	subscriptions := make([]Subscription, 0, len(topics))
+	for _, topic := range topics {
+		subscriptions = append(subscriptions, subs[topic])
+	}
+	return subscriptions
+}
+
+// Bind the topic index for linking the twins.
+func (tp *TwinsPool) bindTopicTree(tt TopicIndex) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	tp.tt = tt
+}
+
+// Set the clean-session flag for the peer-node, the session is clean by default.
+// The persistent session keeps the subscriptions and queues the data while the peer-node is disconnected,
+// and restores them on reconnecting. The clean session discards all of them.
+func (tp *TwinsPool) SetCleanSession(pubK kademlia.PublicKey, clean bool) {
+	tp.qm.release(tp.session(pubK).setClean(clean))
+}
+
+// Return the session of the peer-node, create it if not exist.
+func (tp *TwinsPool) session(pubK kademlia.PublicKey) *session {
+	tp.mu.Lock()
+	ses, exist := tp.mps[pubK]
+	if !exist {
+		ses = newSession()
+		tp.mps[pubK] = ses
+	}
+	tw := tp.mpt[pubK]
+	tp.mu.Unlock()
+
+	if tw != nil && !exist {
+		tw.setSession(ses)
+	}
+	return ses
+}
+
+// Link the twin for the peer-node to the topic, and record the subscription in the session.
+func (tp *TwinsPool) subscribe(provider *TwinServiceProvider, sub Subscription) error {
+	topic := sub.Topic
+	if err := ValidateTopicFilter(topic); err != nil {
+		return err
+	}
+	if sub.Qos > byte(AckGrantedQos2) {
+		return fmt.Errorf("%w: %d", ErrInvalidQos, sub.Qos)
+	}
+	if provider == nil || (*provider).KadID() == nil {
+		return ErrUnknownTwin
+	}
+	pubK := (*provider).KadID().Pub
+	tp.mu.RLock()
+	qs := tp.qs
+	tp.mu.RUnlock()
+	if err := qs.checkTopic(topic); err != nil {
+		return err
+	}
+	tn := tp.tenantOf(pubK)
+	tw, err := tp.acquireTwin(provider)
+	if err != nil {
+		return err
+	}
+
+	tp.smu.Lock()
+	defer tp.smu.Unlock()
+
+	tp.mu.RLock()
+	current, tt := tp.mpt[pubK], tp.tt
+	tp.mu.RUnlock()
+	if current != tw {
+		return fmt.Errorf("%w: the twin has been released", ErrUnknownTwin)
+	}
+	if tt == nil {
+		return fmt.Errorf("the topic tree has not been bound")
+	}
+
+	ses := tp.session(pubK)
+	added := !ses.hasSubscription(topic)
+	if added {
+		if max := qs.MaxSubscriptionsPerPeer; max > 0 && ses.length() >= max {
+			return &QuotaError{Quota: "subscriptions per peer", Limit: int64(max)}
+		}
+		if err := tn.addSubscription(); err != nil {
+			return err
+		}
+	}
+	if err := tp.link(tt, tn.topic(topic), tw); err != nil {
+		if added {
+			tn.removeSubscriptions(1)
+		}
+		return fmt.Errorf("%w: %v", ErrInvalidTopicFilter, err)
+	}
+	ses.addSubscription(sub)
+	return nil
+}
+
+// Unlink the twin for the peer-node from the topic, and remove the subscription from the session.
+// The subscription of the persistent session can be removed while the twin has been released.
+func (tp *TwinsPool) unsubscribe(pubK kademlia.PublicKey, topic []byte) error {
+	if err := ValidateTopicFilter(topic); err != nil {
+		return err
+	}
+	tp.smu.Lock()
+	defer tp.smu.Unlock()
+
+	tp.mu.RLock()
+	tw, tt, ses := tp.mpt[pubK], tp.tt, tp.mps[pubK]
+	tp.mu.RUnlock()
+
+	tn := tp.tenantOf(pubK)
+	if tw == nil {
+		if ses != nil && ses.removeSubscription(topic) {
+			tn.removeSubscriptions(1)
+			return nil
+		}
+		return ErrUnknownTwin
+	}
+	if tt == nil {
+		return fmt.Errorf("the topic tree has not been bound")
+	}
+
+	tn = tw.tenant()
+	if err := tp.unlink(tt, tn.topic(topic), tw); err != nil {
+		return fmt.Errorf("%w: %v", ErrNoSubscription, err)
+	}
+	if ses != nil && ses.removeSubscription(topic) {
+		tn.removeSubscriptions(1)
+	}
+	return nil
+}
+
+// Link the twin to the topic, the shared subscription links the group instead of the twin.
+// The caller holds the subscription lock.
+func (tp *TwinsPool) link(tt TopicIndex, topic []byte, tw *twin) error {
+	group, filter, shared, err := parseSharedTopic(topic)
+	if err != nil {
+		return err
+	}
+	if !shared {
+		return tt.EntityLink(topic, tw)
+	}
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	sg, exist := tp.mpg[string(topic)]
+	if !exist {
+		sg = newShareGroup(group, filter, tp.mss[string(group)])
+		if err := tt.EntityLink(filter, sg); err != nil {
+			return err
+		}
+		tp.mpg[string(topic)] = sg
+	}
+	sg.add(tw)
+	return nil
+}
+
+// Unlink the twin from the topic, the empty shared subscription group would be unlinked too.
+// The caller holds the subscription lock.
+func (tp *TwinsPool) unlink(tt TopicIndex, topic []byte, tw *twin) error {
+	_, filter, shared, err := parseSharedTopic(topic)
+	if err != nil {
+		return err
+	}
+	if !shared {
+		return tt.EntityUnLink(topic, tw)
+	}
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	sg, exist := tp.mpg[string(topic)]
+	if !exist {
+		return fmt.Errorf("the shared subscription '%s' does not exist", topic)
+	}
+	removed, empty := sg.remove(tw)
+	if !removed {
+		return fmt.Errorf("the twin is not the member of the shared subscription '%s'", topic)
+	}
+	if empty {
+		delete(tp.mpg, string(topic))
+		return tt.EntityUnLink(filter, sg)
+	}
+	return nil
+}
+
+// Set the strategy of the shared subscription groups with the name, the round-robin is the default.
+func (tp *TwinsPool) SetShareStrategy(group string, strategy ShareStrategy) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	tp.mss[group] = strategy
+	for _, sg := range tp.mpg {
+		if string(sg.name) == group {
+			sg.setStrategy(strategy)
+		}
+	}
+}
+
+// Set the quotas of the pool, the existing twins and subscriptions beyond the new quotas are kept.
+func (tp *TwinsPool) SetQuotas(qs Quotas) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	tp.qs = qs
+	tp.qm.setMax(qs.MaxQueuedBytes)
+	for _, tw := range tp.mpt {
+		tw.setQueueQuota(qs.MaxQueuedBytesPerTwin, tp.qm)
+	}
+}
+
+// Return nil if one more twin is allowed, the caller holds the lock.
+func (tp *TwinsPool) twinRoom() error {
+	if max := tp.qs.MaxTwins; max > 0 && len(tp.mpt) >= max {
+		return &QuotaError{Quota: "twins", Limit: int64(max)}
+	}
+	return nil
+}
+
+// Return the bytes queued by all the twins.
+func (tp *TwinsPool) queuedBytes() int64 {
+	return tp.qm.length()
+}
+
+// Set the tenants of the peer-nodes, which should be the same as the publish worker's.
+func (tp *TwinsPool) SetTenants(tns *Tenants) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	tp.tns = tns
+}
+
+// Return the tenant of the peer-node, nil if the tenants are not used.
+func (tp *TwinsPool) tenantOf(pubK kademlia.PublicKey) *tenant {
+	tp.mu.RLock()
+	tns := tp.tns
+	tp.mu.RUnlock()
+
+	return tns.tenantOf(pubK)
+}
+
+// Return the provider of the peer-node, either paired or served by the twin.
+func (tp *TwinsPool) providerOf(pubK kademlia.PublicKey) *TwinServiceProvider {
+	tp.mu.RLock()
+	defer tp.mu.RUnlock()
+
+	if prd, exist := tp.mpp[pubK]; exist {
+		return prd
+	}
+	if tw, exist := tp.mpt[pubK]; exist {
+		tw.mu.RLock()
+		defer tw.mu.RUnlock()
+		return tw.prd
+	}
+	return nil
 }
 
 func (tp *TwinsPool) Close() {
+	tp.mu.Lock()
+	hbj, rcj := tp.hbj, tp.rcj
+	tp.hbj, tp.rcj = nil, nil
+	tp.mu.Unlock()
+
+	hbj.stop()
+	rcj.stop()
 	tp.ttp.close()
 	for _, tw := range tp.mpt {
 		tw.close()
@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/TheSmallBoat/cabinet"
 	"github.com/lithdew/kademlia"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
@@ -29,6 +32,127 @@ func (p *provider) Push(data []byte) error {
 	return nil
 }
 
+// The provider blocks the first pushing operation until the gate is closed, and records all the data.
+type gatedProvider struct {
+	kadId *kademlia.ID
+	gate  chan struct{}
+
+	mu   sync.Mutex
+	data [][]byte
+}
+
+func (p *gatedProvider) KadID() *kademlia.ID {
+	return p.kadId
+}
+
+func (p *gatedProvider) Push(data []byte) error {
+	p.mu.Lock()
+	p.data = append(p.data, data)
+	p.mu.Unlock()
+
+	<-p.gate
+	return nil
+}
+
+func (p *gatedProvider) received() [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([][]byte(nil), p.data...)
+}
+
+// The gated provider with the delivery rates.
+type shapedProvider struct {
+	gatedProvider
+	msgRate  float64
+	byteRate float64
+}
+
+func (p *shapedProvider) DeliveryRate() (float64, float64) {
+	return p.msgRate, p.byteRate
+}
+
+// The gated provider with the batch policy, records the size of every batch.
+type batchProvider struct {
+	gatedProvider
+	maxNum   int
+	maxSize  int
+	maxDelay time.Duration
+	sizes    []int
+}
+
+func (p *batchProvider) BatchPolicy() (int, int, time.Duration) {
+	return p.maxNum, p.maxSize, p.maxDelay
+}
+
+func (p *batchProvider) PushBatch(batch [][]byte) error {
+	p.mu.Lock()
+	p.data = append(p.data, batch...)
+	p.sizes = append(p.sizes, len(batch))
+	p.mu.Unlock()
+
+	<-p.gate
+	return nil
+}
+
+func (p *batchProvider) batchSizes() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]int(nil), p.sizes...)
+}
+
+// The provider fails the pushing operations until the number of calls exceeds the fails.
+type flakyProvider struct {
+	kadId  *kademlia.ID
+	fails  int
+	policy RetryPolicy
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (p *flakyProvider) KadID() *kademlia.ID {
+	return p.kadId
+}
+
+func (p *flakyProvider) Push(data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.calls++
+	if p.calls <= p.fails {
+		return fmt.Errorf("calls %d", p.calls)
+	}
+	return nil
+}
+
+func (p *flakyProvider) RetryPolicy() RetryPolicy {
+	return p.policy
+}
+
+func (p *flakyProvider) callNum() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.calls
+}
+
+// The provider answers the ping by the health flag.
+type pingProvider struct {
+	provider
+	healthy int32
+	pings   int32
+}
+
+func (p *pingProvider) Ping() error {
+	atomic.AddInt32(&p.pings, 1)
+	if atomic.LoadInt32(&p.healthy) == 0 {
+		return fmt.Errorf("no pong")
+	}
+	return nil
+}
+
 func generateKadId() (*kademlia.ID, error) {
 	_, sk, err := kademlia.GenerateKeys(nil)
 	if err != nil {
@@ -83,7 +207,8 @@ func TestTwinsPool(t *testing.T) {
 	require.Equal(t, false, tw1.onlineStatus())
 	//require.Equal(t, false, tp.pairStatus(kid1.Pub))
 
-	pn := tp.appendProviders(&prd1)
+	pn, err := tp.appendProviders(&prd1)
+	require.NoError(t, err)
 	require.Equal(t, 1, pn)
 	require.Equal(t, 1, len(tp.mpt))
 	require.Equal(t, 1, len(tp.mpp))
@@ -91,7 +216,7 @@ func TestTwinsPool(t *testing.T) {
 	//require.Equal(t, true, tp.pairStatus(kid1.Pub))
 
 	// the same provider append again
-	pn = tp.appendProviders(&prd1)
+	pn, _ = tp.appendProviders(&prd1)
 	require.Equal(t, 0, pn)
 	require.Equal(t, 1, len(tp.mpt))
 	require.Equal(t, 1, len(tp.mpp))
@@ -261,7 +386,7 @@ func TestTwinsPool(t *testing.T) {
 	require.Equal(t, (*tw2.prd).KadID(), (*tw3.prd).KadID())
 	require.Equal(t, true, tw3.onlineStatus())
 
-	pn = tp.appendProviders(&prd1, &prd2)
+	pn, _ = tp.appendProviders(&prd1, &prd2)
 	require.Equal(t, 1, pn)
 	require.Equal(t, 2, len(tp.mpt))
 	require.Equal(t, 2, len(tp.mpp))
@@ -273,7 +398,7 @@ func TestTwinsPool(t *testing.T) {
 	var prd3 TwinServiceProvider = &provider{kadId: kid3}
 	tw3d := tp.acquire(&prd3)
 	require.Equal(t, true, kid3.Pub == (*tw3d.prd).KadID().Pub)
-	pn = tp.appendProviders(&prd1, &prd2, &prd3)
+	pn, _ = tp.appendProviders(&prd1, &prd2, &prd3)
 	require.Equal(t, 1, pn)
 	require.Equal(t, 3, len(tp.mpt))
 	require.Equal(t, 3, len(tp.mpp))
@@ -336,6 +461,478 @@ func TestTwinsPool(t *testing.T) {
 	require.Equal(t, 0, len(tp.mpp))
 }
 
+func TestTwinPriorityLanes(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tp := NewTwinsPool()
+	defer tp.Close()
+
+	kid, err := generateKadId()
+	require.NoError(t, err)
+
+	gp := &gatedProvider{kadId: kid, gate: make(chan struct{})}
+	var prd TwinServiceProvider = gp
+	tw := tp.acquire(&prd)
+
+	require.NoError(t, tw.pushMessagePacketToChannel([]byte("l0")))
+	require.Eventually(t, func() bool { return len(gp.received()) == 1 }, time.Second, time.Millisecond)
+
+	require.NoError(t, tw.pushMessagePacketWithPriority([]byte("l1"), PriorityLow))
+	require.NoError(t, tw.pushMessagePacketWithPriority([]byte("l2"), PriorityLow))
+	require.NoError(t, tw.pushMessagePacketWithPriority([]byte("h1"), PriorityHigh))
+	require.NoError(t, tw.pushMessagePacketWithPriority([]byte("h2"), PriorityHigh))
+	close(gp.gate)
+
+	require.Eventually(t, func() bool { return len(gp.received()) == 5 }, time.Second, time.Millisecond)
+	require.Equal(t, [][]byte{[]byte("l0"), []byte("h1"), []byte("h2"), []byte("l1"), []byte("l2")}, gp.received())
+	require.Equal(t, uint32(5), tw.pushSucNum)
+}
+
+func TestTwinDeliveryShaper(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tp := NewTwinsPool()
+	defer tp.Close()
+
+	kid, err := generateKadId()
+	require.NoError(t, err)
+
+	sp := &shapedProvider{gatedProvider: gatedProvider{kadId: kid, gate: make(chan struct{})}, msgRate: 2}
+	close(sp.gate)
+	var prd TwinServiceProvider = sp
+	tw := tp.acquire(&prd)
+	require.NotNil(t, tw.msb)
+	require.Nil(t, tw.bsb)
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, tw.pushMessagePacketToChannel([]byte("hello,world")))
+	}
+	require.Eventually(t, func() bool { return len(sp.received()) == 2 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, 2, len(sp.received()))
+
+	// the exit signal interrupts the pacing
+	tw.turnToOffline()
+	require.Equal(t, uint32(2), tw.transSucNum)
+	require.Eventually(t, func() bool { return atomic.LoadUint32(&tw.transErrNum) == 1 }, time.Second, time.Millisecond)
+
+	sp.msgRate, sp.byteRate = 0, 1000
+	tp.release(tw)
+	require.Nil(t, tw.msb)
+	tw = tp.acquire(&prd)
+	require.Nil(t, tw.msb)
+	require.NotNil(t, tw.bsb)
+	require.Equal(t, true, tw.pace(1, 1000))
+	require.Equal(t, true, tw.pace(1, 1))
+}
+
+func TestTwinBatchPusher(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tp := NewTwinsPool()
+	defer tp.Close()
+
+	// section 1: the max number and the max waiting duration
+	kid1, err1 := generateKadId()
+	require.NoError(t, err1)
+
+	bp1 := &batchProvider{gatedProvider: gatedProvider{kadId: kid1, gate: make(chan struct{})}, maxNum: 3, maxDelay: 20 * time.Millisecond}
+	close(bp1.gate)
+	var prd1 TwinServiceProvider = bp1
+	tw1 := tp.acquire(&prd1)
+
+	for i := 0; i < 7; i++ {
+		require.NoError(t, tw1.pushMessagePacketToChannel([]byte("hello,world")))
+	}
+	require.Eventually(t, func() bool { return len(bp1.received()) == 7 }, time.Second, time.Millisecond)
+	require.Equal(t, []int{3, 3, 1}, bp1.batchSizes())
+	require.Eventually(t, func() bool { return atomic.LoadUint32(&tw1.transSucNum) == 7 }, time.Second, time.Millisecond)
+	require.Equal(t, uint64(7*len("hello,world")), atomic.LoadUint64(&tw1.transSucSize))
+
+	// section 2: the max bytes without waiting
+	kid2, err2 := generateKadId()
+	require.NoError(t, err2)
+
+	bp2 := &batchProvider{gatedProvider: gatedProvider{kadId: kid2, gate: make(chan struct{})}, maxSize: 8}
+	var prd2 TwinServiceProvider = bp2
+	tw2 := tp.acquire(&prd2)
+	require.Equal(t, defaultTwinChannelSize, tw2.bpNum)
+
+	require.NoError(t, tw2.pushMessagePacketToChannel([]byte("abcd")))
+	require.Eventually(t, func() bool { return len(bp2.received()) == 1 }, time.Second, time.Millisecond)
+	for i := 0; i < 4; i++ {
+		require.NoError(t, tw2.pushMessagePacketToChannel([]byte("abcd")))
+	}
+	close(bp2.gate)
+
+	require.Eventually(t, func() bool { return len(bp2.received()) == 5 }, time.Second, time.Millisecond)
+	require.Equal(t, []int{1, 2, 2}, bp2.batchSizes())
+
+	// section 3: the data exceeding the max bytes is held back for the next batch
+	kid3, err3 := generateKadId()
+	require.NoError(t, err3)
+
+	bp3 := &batchProvider{gatedProvider: gatedProvider{kadId: kid3, gate: make(chan struct{})}, maxSize: 8}
+	var prd3 TwinServiceProvider = bp3
+	tw3 := tp.acquire(&prd3)
+
+	require.NoError(t, tw3.pushMessagePacketToChannel([]byte("x")))
+	require.Eventually(t, func() bool { return len(bp3.received()) == 1 }, time.Second, time.Millisecond)
+	for _, data := range []string{"abc", "abc", "abcd", "abcdefghij"} {
+		require.NoError(t, tw3.pushMessagePacketToChannel([]byte(data)))
+	}
+	close(bp3.gate)
+
+	require.Eventually(t, func() bool { return len(bp3.received()) == 5 }, time.Second, time.Millisecond)
+	require.Equal(t, []int{1, 2, 1, 1}, bp3.batchSizes())
+	require.Eventually(t, func() bool { return atomic.LoadUint32(&tw3.transSucNum) == 5 }, time.Second, time.Millisecond)
+}
+
+func TestTwinRetry(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tp := NewTwinsPool()
+	defer tp.Close()
+
+	var mu sync.Mutex
+	var letters []*DeadLetter
+	tp.SetDeadLetterHandler(func(dl *DeadLetter) {
+		mu.Lock()
+		letters = append(letters, dl)
+		mu.Unlock()
+	})
+	deadLetters := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return len(letters)
+	}
+
+	kid, err := generateKadId()
+	require.NoError(t, err)
+
+	fp := &flakyProvider{kadId: kid, fails: 2, policy: RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond}}
+	var prd TwinServiceProvider = fp
+	tw := tp.acquire(&prd)
+	require.NotNil(t, tw.rp)
+
+	// succeed at the third attempt
+	require.NoError(t, tw.pushMessagePacketToChannel([]byte("hello,world")))
+	require.Eventually(t, func() bool { return atomic.LoadUint32(&tw.transSucNum) == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, 3, fp.callNum())
+	require.Equal(t, uint32(0), atomic.LoadUint32(&tw.transErrNum))
+	require.Equal(t, 0, deadLetters())
+
+	// exhaust the retries
+	fp.mu.Lock()
+	fp.fails = 6
+	fp.mu.Unlock()
+	require.NoError(t, tw.pushMessagePacketToChannel([]byte("hello,world.")))
+	require.Eventually(t, func() bool { return atomic.LoadUint32(&tw.transErrNum) == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, 6, fp.callNum())
+	require.Eventually(t, func() bool { return deadLetters() == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, []byte("hello,world."), letters[0].Data)
+	require.Equal(t, DeadLetterPushFailed, letters[0].Reason)
+	require.Equal(t, kid, letters[0].KadID)
+	require.Error(t, letters[0].Err)
+
+	// not retryable
+	fp.mu.Lock()
+	fp.fails = 7
+	fp.mu.Unlock()
+	tp.release(tw)
+	fp.policy.Retryable = func(err error) bool { return false }
+	tw = tp.acquire(&prd)
+	require.NoError(t, tw.pushMessagePacketToChannel([]byte("hello,world..")))
+	require.Eventually(t, func() bool { return deadLetters() == 2 }, time.Second, time.Millisecond)
+	require.Equal(t, 7, fp.callNum())
+
+	// the exit signal interrupts the backoff
+	fp.mu.Lock()
+	fp.fails = 100
+	fp.mu.Unlock()
+	tp.release(tw)
+	fp.policy = RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Hour}
+	tw = tp.acquire(&prd)
+	require.NoError(t, tw.pushMessagePacketToChannel([]byte("hello,world...")))
+	require.Eventually(t, func() bool { return fp.callNum() == 8 }, time.Second, time.Millisecond)
+	tw.turnToOffline()
+	require.Eventually(t, func() bool { return deadLetters() == 3 }, time.Second, time.Millisecond)
+	require.Equal(t, DeadLetterPushFailed, letters[2].Reason)
+}
+
+func TestTwinCircuitBreaker(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tp := NewTwinsPool()
+	defer tp.Close()
+
+	kid, err := generateKadId()
+	require.NoError(t, err)
+
+	fp := &flakyProvider{kadId: kid, fails: 5}
+	var prd TwinServiceProvider = fp
+	tw := tp.acquire(&prd)
+	tp.SetCircuitBreaker(3, 5*time.Millisecond)
+	require.Equal(t, uint32(3), tw.cbThreshold)
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, tw.pushMessagePacketToChannel([]byte("hello,world")))
+	}
+
+	// tripped by the third failure
+	require.Eventually(t, func() bool { return !tw.onlineStatus() }, time.Second, time.Millisecond)
+	require.Equal(t, true, tw.runningStatus())
+	require.Equal(t, uint32(2), atomic.LoadUint32(&tw.transErrNum))
+	require.Error(t, tw.pushMessagePacketToChannel([]byte("hello,world")))
+	scTime := tw.scTime
+
+	// the pair checking does not turn the tripped twin to online
+	pn, _ := tp.appendProviders(&prd)
+	require.Equal(t, 1, pn)
+	require.Equal(t, false, tw.onlineStatus())
+
+	// recovered by the probing at the sixth call, and then the queued data would be pushed
+	require.Eventually(t, func() bool { return tw.onlineStatus() }, time.Second, time.Millisecond)
+	require.Equal(t, true, tw.scTime.After(scTime))
+	require.Eventually(t, func() bool { return atomic.LoadUint32(&tw.transSucNum) == 2 }, time.Second, time.Millisecond)
+	require.Equal(t, 7, fp.callNum())
+	require.Equal(t, uint32(0), atomic.LoadUint32(&tw.cbFails))
+
+	// trip again, and then turn to offline while probing
+	fp.mu.Lock()
+	fp.fails = 100
+	fp.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, tw.pushMessagePacketToChannel([]byte("hello,world")))
+	}
+	require.Eventually(t, func() bool { return !tw.onlineStatus() }, time.Second, time.Millisecond)
+	tw.turnToOffline()
+	require.Equal(t, false, tw.runningStatus())
+	require.Eventually(t, func() bool { return atomic.LoadUint32(&tw.transErrNum) == 5 }, time.Second, time.Millisecond)
+
+	tw.turnToOnline()
+	require.Equal(t, true, tw.onlineStatus())
+
+	// the failures not by the pushing are not counted
+	cbFails := atomic.LoadUint32(&tw.cbFails)
+	tw.fail([][]byte{[]byte("a"), []byte("b")}, DeadLetterTwinOffline, fmt.Errorf("offline"))
+	require.Equal(t, cbFails, atomic.LoadUint32(&tw.cbFails))
+
+	// the zero interval means the default, and the turning to offline interrupts the probing
+	tp.SetCircuitBreaker(1, 0)
+	require.Equal(t, defaultCircuitBreakerInterval, tw.cbInterval)
+	require.NoError(t, tw.pushMessagePacketToChannel([]byte("hello,world")))
+	require.Eventually(t, func() bool { return !tw.onlineStatus() }, time.Second, time.Millisecond)
+	callNum := fp.callNum()
+	tw.turnToOffline()
+	require.Equal(t, false, tw.runningStatus())
+	require.Equal(t, callNum, fp.callNum())
+}
+
+func TestTwinsPoolHeartbeat(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tp := NewTwinsPool()
+	defer tp.Close()
+
+	kid1, err1 := generateKadId()
+	require.NoError(t, err1)
+	kid2, err2 := generateKadId()
+	require.NoError(t, err2)
+
+	pp := &pingProvider{provider: provider{kadId: kid1}, healthy: 1}
+	var prd1 TwinServiceProvider = pp
+	var prd2 TwinServiceProvider = &provider{kadId: kid2}
+	pn, err := tp.appendProviders(&prd1, &prd2)
+	require.NoError(t, err)
+	require.Equal(t, 2, pn)
+	tw1, tw2 := tp.acquire(&prd1), tp.acquire(&prd2)
+
+	tp.SetHeartbeat(time.Millisecond, 3)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&pp.pings) > 3 }, time.Second, time.Millisecond)
+	require.Equal(t, true, tw1.onlineStatus())
+
+	// offline after the missed heartbeats
+	atomic.StoreInt32(&pp.healthy, 0)
+	require.Eventually(t, func() bool { return !tw1.onlineStatus() }, time.Second, time.Millisecond)
+	require.Equal(t, true, tw1.unhealthyStatus())
+	require.Equal(t, true, atomic.LoadUint32(&tw1.hbMiss) >= 3)
+	require.Equal(t, true, tw2.onlineStatus())
+
+	// the pair checking and the acquiring do not turn the unhealthy twin to online
+	otn, mtn := tp.checkTwinsProvidersPairStatus()
+	require.Equal(t, 0, otn)
+	require.Equal(t, 0, mtn)
+	require.Equal(t, tw1, tp.acquire(&prd1))
+
+	// online again after the successful heartbeat
+	atomic.StoreInt32(&pp.healthy, 1)
+	require.Eventually(t, func() bool { return tw1.onlineStatus() }, time.Second, time.Millisecond)
+	require.Equal(t, false, tw1.unhealthyStatus())
+
+	// disable the heartbeat
+	tp.SetHeartbeat(0, 0)
+	time.Sleep(2 * time.Millisecond)
+	pings := atomic.LoadInt32(&pp.pings)
+	time.Sleep(5 * time.Millisecond)
+	require.Equal(t, pings, atomic.LoadInt32(&pp.pings))
+
+	tp.SetHeartbeat(time.Millisecond, 1)
+
+	// the twin without the paired provider is neither pinged nor turned to online
+	atomic.StoreInt32(&pp.healthy, 0)
+	require.Eventually(t, func() bool { return tw1.unhealthyStatus() }, time.Second, time.Millisecond)
+	tp.removeProviders(&prd1)
+	time.Sleep(5 * time.Millisecond)
+	pings = atomic.LoadInt32(&pp.pings)
+	atomic.StoreInt32(&pp.healthy, 1)
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, false, tw1.onlineStatus())
+	require.Equal(t, pings, atomic.LoadInt32(&pp.pings))
+}
+
+// The gated provider without the pong.
+type deafProvider struct {
+	gatedProvider
+	pings int32
+}
+
+func (p *deafProvider) Ping() error {
+	atomic.AddInt32(&p.pings, 1)
+	return fmt.Errorf("no pong")
+}
+
+func TestTwinsPoolHeartbeatSlowPush(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tp := NewTwinsPool()
+	defer tp.Close()
+
+	kid, err := generateKadId()
+	require.NoError(t, err)
+	dp := &deafProvider{gatedProvider: gatedProvider{kadId: kid, gate: make(chan struct{})}}
+	var prd TwinServiceProvider = dp
+	_, err = tp.appendProviders(&prd)
+	require.NoError(t, err)
+	tw := tp.acquire(&prd)
+
+	// the task is blocked by the pushing, so the heartbeat turning to offline waits for it
+	require.NoError(t, tw.pushMessagePacketToChannel([]byte("hello,world")))
+	require.Eventually(t, func() bool { return len(dp.received()) == 1 }, time.Second, time.Millisecond)
+	tp.SetHeartbeat(time.Millisecond, 1)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&dp.pings) == 1 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, int32(1), atomic.LoadInt32(&dp.pings))
+
+	// the concurrent turning to offline is safe
+	done := make(chan struct{})
+	go func() {
+		tw.turnToOffline()
+		close(done)
+	}()
+	close(dp.gate)
+	<-done
+	require.Eventually(t, func() bool { return tw.unhealthyStatus() }, time.Second, time.Millisecond)
+	require.Equal(t, false, tw.runningStatus())
+	tp.SetHeartbeat(0, 0)
+}
+
+func TestTwinsPoolReconcile(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tp := NewTwinsPool()
+	defer tp.Close()
+
+	kid1, err1 := generateKadId()
+	require.NoError(t, err1)
+	kid2, err2 := generateKadId()
+	require.NoError(t, err2)
+
+	var prd1 TwinServiceProvider = &provider{kadId: kid1}
+	var prd2 TwinServiceProvider = &provider{kadId: kid2}
+
+	// the twin without the provider, and the provider without the twin
+	tw1 := tp.acquire(&prd1)
+	tp.mu.Lock()
+	tp.mpp[kid2.Pub] = &prd2
+	tp.mu.Unlock()
+
+	var mu sync.Mutex
+	var reports []ReconcileReport
+	tp.SetMaxOfflineTimeDuration(5 * time.Millisecond)
+	tp.SetReconcile(time.Millisecond, func(rr ReconcileReport) {
+		mu.Lock()
+		reports = append(reports, rr)
+		mu.Unlock()
+	})
+
+	require.Eventually(t, func() bool {
+		twn, _ := tp.length()
+		_, exist := tp.existTwin(kid2.Pub)
+		return twn == 1 && exist
+	}, time.Second, time.Millisecond)
+	require.Equal(t, false, tw1.onlineStatus())
+
+	tp.SetReconcile(0, nil)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var excess, lacking, released = 0, 0, 0
+	for _, rr := range reports {
+		excess += rr.ExcessTwinNum
+		lacking += rr.LackingTwinNum
+		released += rr.ReleasedTwinNum
+	}
+	require.Equal(t, true, excess >= 1)
+	require.Equal(t, 1, lacking)
+	require.Equal(t, 1, released)
+}
+
+func TestTwinsPoolReleaseUnlink(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		err := tt.Close()
+		require.NoError(t, err)
+	}()
+
+	tp := NewTwinsPool()
+	defer tp.Close()
+	tp.bindTopicTree(tt)
+
+	kid1, err1 := generateKadId()
+	require.NoError(t, err1)
+	kid2, err2 := generateKadId()
+	require.NoError(t, err2)
+
+	var prd1 TwinServiceProvider = &provider{kadId: kid1}
+	var prd2 TwinServiceProvider = &provider{kadId: kid2}
+
+	require.NoError(t, tp.subscribe(&prd1, Subscription{Topic: []byte("/finance/tom"), Qos: 1}))
+	require.NoError(t, tp.subscribe(&prd1, Subscription{Topic: []byte("/finance/#"), Qos: 0}))
+	require.Equal(t, []Subscription{
+		{Topic: []byte("/finance/#"), Qos: 0},
+		{Topic: []byte("/finance/tom"), Qos: 1},
+	}, tp.SubscriptionsOf(kid1.Pub))
+	require.Empty(t, tp.SubscriptionsOf(kid2.Pub))
+
+	tw1, exist := tp.existTwin(kid1.Pub)
+	require.True(t, exist)
+	tp.release(tw1)
+	require.Empty(t, tp.SubscriptionsOf(kid1.Pub))
+
+	// The recycled twin belongs to the other provider, and must not receive the data of the released one.
+	require.NoError(t, tp.subscribe(&prd2, Subscription{Topic: []byte("/finance/jack"), Qos: 0}))
+	entities := make([]interface{}, 0)
+	require.NoError(t, tt.LinkedEntities([]byte("/finance/tom"), &entities))
+	require.Empty(t, entities)
+	require.NoError(t, tt.LinkedEntities([]byte("/finance/jack"), &entities))
+	require.Equal(t, 1, len(entities))
+}
+
 func BenchmarkTwinsPool(b *testing.B) {
 	tp := NewTwinsPool()
 	defer tp.Close()
@@ -374,3 +971,339 @@ func BenchmarkTwinsPool(b *testing.B) {
 		}
 	}
 }
+
+func TestTwinsPoolReleaseWhilePushing(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tp := NewTwinsPool()
+	defer tp.Close()
+
+	kid, err := generateKadId()
+	require.NoError(t, err)
+	gp := &gatedProvider{kadId: kid, gate: make(chan struct{})}
+	var prd TwinServiceProvider = gp
+	tw := tp.acquire(&prd)
+
+	// the pushing beyond the channel size is blocked
+	var wg sync.WaitGroup
+	var errNum int32
+	for i := 0; i < 2*defaultTwinChannelSize; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if tw.pushMessagePacketToChannel([]byte("hello,world")) != nil {
+				atomic.AddInt32(&errNum, 1)
+			}
+		}()
+	}
+	require.Eventually(t, func() bool { return len(tw.tc) == defaultTwinChannelSize }, time.Second, time.Millisecond)
+
+	// the releasing wakes the blocked pushing without the panic
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		close(gp.gate)
+	}()
+	tp.release(tw)
+	wg.Wait()
+	require.Equal(t, true, atomic.LoadInt32(&errNum) > 0)
+	require.Equal(t, 0, tw.queueDepth())
+	require.Nil(t, tw.provider())
+	require.Error(t, tw.pushMessagePacketToChannel([]byte("hello,world")))
+}
+
+func TestTwinsPoolReleaseToDeadLetter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tp := NewTwinsPool()
+	defer tp.Close()
+
+	var mu sync.Mutex
+	var dls []*DeadLetter
+	tp.SetDeadLetterHandler(func(dl *DeadLetter) {
+		mu.Lock()
+		defer mu.Unlock()
+		dls = append(dls, dl)
+	})
+	deadLetters := func() []*DeadLetter {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*DeadLetter(nil), dls...)
+	}
+
+	kid, err := generateKadId()
+	require.NoError(t, err)
+	gp := &gatedProvider{kadId: kid, gate: make(chan struct{})}
+	var prd TwinServiceProvider = gp
+	tw := tp.acquire(&prd)
+
+	num := defaultTwinChannelSize
+	for i := 0; i < num; i++ {
+		require.NoError(t, tw.pushMessagePacketToChannel([]byte(fmt.Sprintf("m%d", i))))
+	}
+	require.Eventually(t, func() bool { return len(gp.received()) == 1 }, time.Second, time.Millisecond)
+
+	// the data remaining in the channels is passed to the dead-letter handler without the session
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		close(gp.gate)
+	}()
+	tp.release(tw)
+
+	delivered := gp.received()
+	require.Equal(t, true, len(deadLetters()) > 0)
+	require.Equal(t, num, len(delivered)+len(deadLetters()))
+	for i, dl := range deadLetters() {
+		require.Equal(t, DeadLetterTwinOffline, dl.Reason)
+		require.Equal(t, kid.Pub, dl.KadID.Pub)
+		require.Equal(t, []byte(fmt.Sprintf("m%d", len(delivered)+i)), dl.Data)
+	}
+	require.Equal(t, 0, tw.queueDepth())
+}
+
+func TestTwinsPoolOverflowPolicy(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tp := NewTwinsPool()
+	defer tp.Close()
+
+	var mu sync.Mutex
+	var dls []*DeadLetter
+	tp.SetDeadLetterHandler(func(dl *DeadLetter) {
+		mu.Lock()
+		defer mu.Unlock()
+		dls = append(dls, dl)
+	})
+	deadLetters := func() []*DeadLetter {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*DeadLetter(nil), dls...)
+	}
+
+	kid, err := generateKadId()
+	require.NoError(t, err)
+	gp := &gatedProvider{kadId: kid, gate: make(chan struct{})}
+	var prd TwinServiceProvider = gp
+	tw := tp.acquire(&prd)
+
+	// the task is blocked by the first data, and the channel is full of the others
+	require.NoError(t, tw.pushMessagePacketToChannel([]byte("m0")))
+	require.Eventually(t, func() bool { return len(gp.received()) == 1 }, time.Second, time.Millisecond)
+	for i := 1; i <= defaultTwinChannelSize; i++ {
+		require.NoError(t, tw.pushMessagePacketToChannel([]byte(fmt.Sprintf("m%d", i))))
+	}
+
+	// drop the newest data
+	tp.SetOverflowPolicy(OverflowDropNewest)
+	err = tw.pushMessagePacketToChannel([]byte("n"))
+	require.Equal(t, ErrTwinOverflow, err)
+	require.Equal(t, defaultTwinChannelSize, tw.queueDepth())
+
+	// the publish worker passes the dropped data to the dead letter
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		err := tt.Close()
+		require.NoError(t, err)
+	}()
+	pw := NewPublishWorker(kid, tt)
+	defer pw.Close()
+	var pdl *DeadLetter
+	pw.SetDeadLetterHandler(func(dl *DeadLetter) { pdl = dl })
+	forwardToTwin(pw, NewMessagePacket(kid, uint32(1), byte(0), []byte("/finance/tom"), []byte("n")), tw, PriorityLow)
+	require.Equal(t, uint32(1), pw.fwdErrNum)
+	require.Equal(t, DeadLetterOverflow, pdl.Reason)
+	require.Equal(t, kid.Pub, pdl.KadID.Pub)
+
+	// spill without the persistent session
+	tp.SetOverflowPolicy(OverflowSpill)
+	err = tw.pushMessagePacketToChannel([]byte("n"))
+	require.Equal(t, ErrTwinOverflow, err)
+	require.Equal(t, 0, len(deadLetters()))
+
+	// drop the oldest data
+	tp.SetOverflowPolicy(OverflowDropOldest)
+	require.NoError(t, tw.pushMessagePacketToChannel([]byte("o")))
+	require.Equal(t, defaultTwinChannelSize, tw.queueDepth())
+	require.Equal(t, 1, len(deadLetters()))
+	require.Equal(t, DeadLetterOverflow, deadLetters()[0].Reason)
+	require.Equal(t, []byte("m1"), deadLetters()[0].Data)
+
+	// spill into the persistent session, which overtakes the data in the channel
+	tp.SetCleanSession(kid.Pub, false)
+	tp.SetOverflowPolicy(OverflowSpill)
+	require.NoError(t, tw.pushMessagePacketToChannel([]byte("s")))
+	require.Equal(t, defaultTwinChannelSize, tw.queueDepth())
+	size := len("o") + len("s")
+	for i := 2; i <= defaultTwinChannelSize; i++ {
+		size += len(fmt.Sprintf("m%d", i))
+	}
+	queued := tw.queuedBytes()
+
+	close(gp.gate)
+	require.Equal(t, int64(size), queued)
+	require.Eventually(t, func() bool { return len(gp.received()) == defaultTwinChannelSize+2 }, time.Second, time.Millisecond)
+	received := gp.received()
+	require.Equal(t, []byte("s"), received[1])
+	require.Equal(t, []byte("o"), received[len(received)-1])
+	require.Equal(t, int64(0), tw.queuedBytes())
+	require.Equal(t, 1, len(deadLetters()))
+}
+
+func TestTwinsPoolReconnect(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		err := tt.Close()
+		require.NoError(t, err)
+	}()
+
+	twp := NewTwinsPool()
+	defer twp.Close()
+	sw := NewSubscribeWorker(twp, tt)
+	defer sw.Close()
+
+	bKid, err := generateKadId()
+	require.NoError(t, err)
+	pw := NewPublishWorker(bKid, tt)
+	defer pw.Close()
+
+	kid, err := generateKadId()
+	require.NoError(t, err)
+	pKid, err := generateKadId()
+	require.NoError(t, err)
+	gate := make(chan struct{})
+	close(gate)
+	gp1 := &gatedProvider{kadId: kid, gate: gate}
+	gp2 := &gatedProvider{kadId: kid, gate: gate}
+	var prd1 TwinServiceProvider = gp1
+	var prd2 TwinServiceProvider = gp2
+
+	twp.SetCleanSession(kid.Pub, false)
+	_, err = twp.appendProviders(&prd1)
+	require.NoError(t, err)
+	require.NoError(t, (<-sw.PeerNodeSubscribe(&prd1, byte(0), []byte("/finance/tom"))).Err)
+
+	// the peer-node disconnects, and the data is queued in the session
+	twp.removeProviders(&prd1)
+	tw, exist := twp.existTwin(kid.Pub)
+	require.True(t, exist)
+	require.False(t, tw.onlineStatus())
+	require.NoError(t, pw.WorkFor(NewMessagePacket(pKid, uint32(1), byte(0), []byte("/finance/tom"), []byte("m1"))))
+	pw.Wait()
+
+	// the peer-node reconnects before the twin is released, the twin serves the new connection
+	_, err = twp.appendProviders(&prd2)
+	require.NoError(t, err)
+	tw_, exist := twp.existTwin(kid.Pub)
+	require.True(t, exist)
+	require.Equal(t, tw, tw_)
+	require.True(t, tw.onlineStatus())
+	require.True(t, &prd2 == tw.provider())
+	require.NoError(t, pw.WorkFor(NewMessagePacket(pKid, uint32(2), byte(0), []byte("/finance/tom"), []byte("m2"))))
+	pw.Wait()
+
+	require.Eventually(t, func() bool { return len(gp2.received()) == 2 }, time.Second, time.Millisecond)
+	require.Equal(t, 0, len(gp1.received()))
+
+	// the reconnecting without the removing replaces the paired provider too
+	gp3 := &gatedProvider{kadId: kid, gate: gate}
+	var prd3 TwinServiceProvider = gp3
+	_, err = twp.appendProviders(&prd3)
+	require.NoError(t, err)
+	prd, exist := twp.existServiceProvider(kid.Pub)
+	require.True(t, exist)
+	require.True(t, &prd3 == prd)
+	require.True(t, &prd3 == tw.provider())
+	require.NoError(t, pw.WorkFor(NewMessagePacket(pKid, uint32(3), byte(0), []byte("/finance/tom"), []byte("m3"))))
+	pw.Wait()
+	require.Eventually(t, func() bool { return len(gp3.received()) == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, 2, len(gp2.received()))
+	sw.Wait()
+}
+
+func TestTwinsPoolDisconnectCleanSession(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		err := tt.Close()
+		require.NoError(t, err)
+	}()
+
+	twp := NewTwinsPool()
+	defer twp.Close()
+	sw := NewSubscribeWorker(twp, tt)
+	defer sw.Close()
+
+	kid, err := generateKadId()
+	require.NoError(t, err)
+	var prd TwinServiceProvider = &provider{kadId: kid}
+	_, err = twp.appendProviders(&prd)
+	require.NoError(t, err)
+	require.NoError(t, (<-sw.PeerNodeSubscribe(&prd, byte(0), []byte("/finance/jack"))).Err)
+	require.Equal(t, 1, len(twp.SubscriptionsOf(kid.Pub)))
+
+	// the subscriptions of the clean session are dropped on disconnecting, while the twin is kept
+	twp.removeProviders(&prd)
+	_, exist := twp.existTwin(kid.Pub)
+	require.True(t, exist)
+	require.Empty(t, twp.SubscriptionsOf(kid.Pub))
+	entities := make([]interface{}, 0)
+	require.NoError(t, tt.LinkedEntities([]byte("/finance/jack"), &entities))
+	require.Empty(t, entities)
+
+	// the reconnected peer-node starts without the old subscriptions
+	_, err = twp.appendProviders(&prd)
+	require.NoError(t, err)
+	require.Empty(t, twp.SubscriptionsOf(kid.Pub))
+	require.NoError(t, (<-sw.PeerNodeSubscribe(&prd, byte(0), []byte("/finance/tom"))).Err)
+	require.Equal(t, []Subscription{{Topic: []byte("/finance/tom")}}, twp.SubscriptionsOf(kid.Pub))
+	sw.Wait()
+}
+
+// The gated provider always fails to push.
+type failingProvider struct {
+	gatedProvider
+}
+
+func (p *failingProvider) Push(data []byte) error {
+	_ = p.gatedProvider.Push(data)
+	return fmt.Errorf("broken pipe")
+}
+
+func TestTwinsPoolCircuitBreakerWakesPushing(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tp := NewTwinsPool()
+	defer tp.Close()
+	tp.SetCircuitBreaker(1, 10*time.Millisecond)
+
+	kid, err := generateKadId()
+	require.NoError(t, err)
+	fp := &failingProvider{gatedProvider: gatedProvider{kadId: kid, gate: make(chan struct{})}}
+	var prd TwinServiceProvider = fp
+	tw := tp.acquire(&prd)
+
+	// the task is blocked by the first data, and the channel is full of the others
+	require.NoError(t, tw.pushMessagePacketToChannel([]byte("m0")))
+	require.Eventually(t, func() bool { return len(fp.received()) == 1 }, time.Second, time.Millisecond)
+	for i := 1; i <= defaultTwinChannelSize; i++ {
+		require.NoError(t, tw.pushMessagePacketToChannel([]byte(fmt.Sprintf("m%d", i))))
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- tw.pushMessagePacketToChannel([]byte("blocked"))
+	}()
+
+	// the tripping wakes the blocked pushing, which fails without the persistent session
+	close(fp.gate)
+	select {
+	case err := <-done:
+		require.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the pushing is still blocked after the tripping")
+	}
+	require.False(t, tw.onlineStatus())
+	require.True(t, tw.runningStatus())
+	require.Equal(t, defaultTwinChannelSize, tw.queueDepth())
+}